@@ -0,0 +1,242 @@
+package lex
+
+import (
+	"fmt"
+	"testing"
+)
+
+// evalNode で使う評価の方法
+var testBackend = TreeWalk
+
+// testBackend の方法で構文木を評価する
+func evalNode(ip *Interpreter, e Expr, env *Env) Value {
+	ip.Backend = testBackend
+	return ip.evalExpr(e, env)
+}
+
+// lex_test.go と variables_test.go のテストをどちらの評価の方法でも実行する
+func TestBackends(t *testing.T) {
+	tests := []struct {
+		name string
+		test func(*testing.T)
+	}{
+		{"Lex_getToken", TestLex_getToken},
+		{"Ops_Eval", TestOps_Eval},
+		{"Sel_Eval", TestSel_Eval},
+		{"TopLevel", TestTopLevel},
+		{"expr1", Test_expr1},
+		{"expr2", Test_expr2},
+		{"expr3", Test_expr3},
+		{"expression", Test_expression},
+		{"factor", Test_factor},
+		{"getArgs", Test_getArgs},
+		{"initKeyTable", Test_initKeyTable},
+		{"makeSel", Test_makeSel},
+		{"newOps", Test_newOps},
+		{"newSel", Test_newSel},
+		{"term", Test_term},
+		{"Agn_Eval", TestAgn_Eval},
+		{"App_Eval", TestApp_Eval},
+		{"Func1_Argc", TestFunc1_Argc},
+		{"Func2_Argc", TestFunc2_Argc},
+		{"InitFunc", TestInitFunc},
+		{"Variable_Eval", TestVariable_Eval},
+		{"newAgn", Test_newAgn},
+		{"newApp", Test_newApp},
+	}
+	defer func() { testBackend = TreeWalk }()
+	for _, b := range []Backend{TreeWalk, Bytecode} {
+		testBackend = b
+		for _, tt := range tests {
+			t.Run(b.String()+"/"+tt.name, tt.test)
+		}
+	}
+}
+
+// 同じ式をどちらの方法で評価しても、値・エラー・数えた歩数が同じになる
+func TestBackends_Same(t *testing.T) {
+	srcs := []string{
+		"1 + 2 * 3 - 4 / 2",
+		"2 ^ 3 ^ 2 + -2 ^ 2 + 7 % 3 + 7 // 2",
+		"6 & 3 | 8 xor 1 << 2",
+		"1 < 2 < 3 and 3 > 2 > 2",
+		"n = 0; def f() begin n = n + 1, 2 end end 1 < f() < 3; 3 < 2 < f(); n",
+		"0 and x or 5",
+		"x = 1; x += 2; x *= 3; x -= 1; x /= 4",
+		"if 1 then 2 else 3 end + if 0 then 4 end",
+		"i = 0; s = 0; while i < 10 do s = s + i, i = i + 1 end; s",
+		"s = 0; for x in [1, 2, 3] do s = s + x end; s",
+		`s = ""; for c in "abc" do s = c + s end; s`,
+		`m = {"a": 1, "b": 2}; s = ""; for k in m do s = s + k end; s`,
+		"let a = 1, b = a + 1 in let a = 10 in a + b end end",
+		"let a = 1 in a += 5, a end",
+		"fs = []; for i in [1, 2, 3] do fs = fs + [fn() i end] end; map(fn(f) f() end, fs)",
+		"make = fn(n) fn(x) x + n end end; add2 = make(2); add2(3)",
+		"counter = let n = 0 in fn() n = n + 1 end end; counter(); counter(); counter()",
+		"def fib(n) if n < 2 then n else fib(n - 1) + fib(n - 2) end end fib(15)",
+		"def loop(n, acc) if n == 0 then acc else loop(n - 1, acc + n) end end loop(1000, 0)",
+		"g = fn(n, acc) if n == 0 then acc else let m = n - 1 in g(m, acc * 2) end end end; g(200, 1)",
+		"def f(n) if n == 0 then sqrt else begin 0, f(n - 1) end end end f(300)(16)",
+		"def f(g, n) if n == 0 then g(n) else f(g, n - 1) end end f(abs, 300)",
+		"declare odd(n); def even(n) if n == 0 then true else odd(n - 1) end end def odd(n) if n == 0 then false else even(n - 1) end end even(10)",
+		"memo def fib(n) if n < 2 then n else fib(n - 1) + fib(n - 2) end end [fib(40), fib(30), memostats(fib)]",
+		"memo def f(n, acc) if n == 0 then acc else f(n - 1, acc + n) end end [f(100, 0), f(50, 3775), memostats(f)]",
+		"memo def f(n) if n == 0 then [n] else f(n - 1) end end [f(3), f(3), memostats(f)]",
+		"reduce(fn(a, b) a * b end, [1, 2, 3, 4], 1)",
+		"integrate(fn(x) x * x end, 0, 3)",
+		"xs = [1, 2, 3, 4]; xs[1] = 20; xs[-1] += 1; [xs, xs[1:3], xs[:-1], xs[2:]]",
+		`m = {"a": 1}; m.b = 2; m["a"] *= 10; m`,
+		`s = "hello"; [s[0], s[-1], s[1:3], len(s)]`,
+		"const r = 2; pi * r ^ 2",
+		"infix 6 left <+> (a, b) a * b + a + b end 1 <+> 2 <+> 3",
+		"sqrt(16) + max(1, 5, 3) + abs(-2)",
+		"f = sqrt; f(9)",
+		"begin 1, 2, 3 end",
+		"[1, [2, 3], {}]",
+		"not 0 == 1",
+		// エラー
+		"y + 1",
+		"1 + \"a\"",
+		"[1, 2][5]",
+		"def f(x) x[3] end f([1])",
+		"g = fn(x) x + nil end; g(1)",
+		"g = fn(x) x end; g(1, 2)",
+		"map(fn(x) x / \"a\" end, [1])",
+		"3(1)",
+		"def f(x) sqrt(\"a\") end f(1)",
+		"def f(n) f(n + 1) + 1 end f(0)",
+		"g = fn(n) g(n + 1) + 1 end; g(0)",
+		"def f(n) if n == 0 then 1 + nil else f(n - 1) end end f(5)",
+		"g = fn(n) if n == 0 then sqrt(\"a\") else g(n - 1) end end; g(5)",
+		"def f(n) if n == 0 then [][1] else begin 0, let m = n - 1 in h(m) end end end end def h(n) f(n) end f(5)",
+		"declare h(n); h(1)",
+		"for x in 3 do x end",
+		`{"a": 1, nil: 2}`,
+		"pi = 3",
+		"const r = 1; const r = 2",
+		"x = 1; x += \"a\"",
+		"1.5 & 1",
+		"[1, 2][\"a\"]",
+	}
+	for _, src := range srcs {
+		t.Run(src, func(t *testing.T) {
+			tree := evalWith(TreeWalk, src)
+			vm := evalWith(Bytecode, src)
+			if tree != vm {
+				t.Errorf("tree: %v\nbytecode: %v", tree, vm)
+			}
+		})
+	}
+}
+
+// 評価した値 (またはエラー) と歩数
+func evalWith(b Backend, src string) string {
+	ip := NewInterpreter()
+	ip.Backend = b
+	ip.MaxDepth = 100
+	e, err := ip.Parse(src)
+	if err != nil {
+		return "parse error: " + err.Error()
+	}
+	v, err := ip.Eval(e)
+	if err != nil {
+		return fmt.Sprintf("error: %v (%d steps)", err, ip.steps)
+	}
+	return fmt.Sprintf("%v (%d steps)", v, ip.steps)
+}
+
+// 上限を超えたときもどちらの方法でも同じ位置で止まる
+func TestBackends_Limits(t *testing.T) {
+	src := "def f(n) if n == 0 then 0 else f(n - 1) + 1 end end f(30); i = 0; while 1 do i = i + 1 end"
+	var want string
+	for _, b := range []Backend{TreeWalk, Bytecode} {
+		ip := NewInterpreter()
+		ip.Backend = b
+		ip.Limits.MaxSteps = 1000
+		e, err := ip.Parse(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ip.Eval(e)
+		if err == nil {
+			t.Fatalf("%v: want error", b)
+		}
+		got := fmt.Sprintf("%v (%d steps)", err, ip.steps)
+		if b == TreeWalk {
+			want = got
+		} else if got != want {
+			t.Errorf("bytecode: %v, tree: %v", got, want)
+		}
+	}
+}
+
+func TestProgram_Backend(t *testing.T) {
+	ip := NewInterpreter()
+	ip.Backend = Bytecode
+	p, err := ip.Compile("def sq(x) x * x end sq(a) + sq(b)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.expr.(*code); !ok {
+		t.Errorf("Program is not compiled: %T", p.expr)
+	}
+	for i := 0; i < 2; i++ {
+		if got, err := p.Run(map[string]float64{"a": 3, "b": 4}); err != nil || got != Num(25) {
+			t.Errorf("Run() = %v, %v, want 25", got, err)
+		}
+	}
+}
+
+// Go で作った知らない節
+type rawExpr struct{}
+
+func (rawExpr) Eval(ip *Interpreter, env *Env) Value {
+	return Num(2)
+}
+
+// 知らない節を含む式はコンパイルせずに構文木のまま評価する
+func TestBackends_Unknown(t *testing.T) {
+	e := newOp2('+', rawExpr{}, Num(1))
+	if c := compile(e); c != nil {
+		t.Errorf("compile() = %v, want nil", c)
+	}
+	ip := NewInterpreter()
+	ip.Backend = Bytecode
+	if got, err := ip.Eval(e); err != nil || got != Num(3) {
+		t.Errorf("Eval() = %v, %v, want 3", got, err)
+	}
+}
+
+// 再帰呼び出しと深い let の速さ
+// 割り当ても数えるので、局所変数の環境の作り方を変えたときに比べられる
+func BenchmarkFib(b *testing.B) {
+	benchmarkSrc(b, "def fib(n) if n < 2 then n else fib(n - 1) + fib(n - 2) end end", "fib(20)")
+}
+
+func BenchmarkDeepLet(b *testing.B) {
+	benchmarkSrc(b, "def f(a, b, c, d) let e = a + b, g = c + d in let h = e * g in a + h end end end",
+		"s = 0; for i in range(10000) do s = s + f(i, 1, 2, 3) end; s")
+}
+
+func benchmarkSrc(b *testing.B, def, src string) {
+	for _, backend := range []Backend{TreeWalk, Bytecode} {
+		b.Run(backend.String(), func(b *testing.B) {
+			b.ReportAllocs()
+			ip := NewInterpreter()
+			ip.Backend = backend
+			if _, err := ip.Parse(def); err != nil {
+				b.Fatal(err)
+			}
+			e, err := ip.Parse(src)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := ip.Eval(e); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,17 +1,25 @@
 package lex
 
 func boolToValue(x bool) Value {
-	if x {
-		return 1.0
-	} else {
-		return 0.0
-	}
+	return Bool(x)
 }
 
-func isTrue(x Value) bool{
-	return x != 0.0
+// false, nil, 0, 空文字列は偽、それ以外は真
+func isTrue(x Value) bool {
+	switch v := x.(type) {
+	case Bool:
+		return bool(v)
+	case Nil:
+		return false
+	case Num:
+		return v != 0
+	case Str:
+		return v != ""
+	default:
+		return true
+	}
 }
 
-func isFalse(x Value) bool{
-	return x == 0.0
+func isFalse(x Value) bool {
+	return !isTrue(x)
 }
@@ -0,0 +1,386 @@
+package lex
+
+import "fmt"
+
+// バイトコードの命令
+// 命令は uint32 で、下位 8 ビットが命令コード、上位 24 ビットがオペランド。
+// 後ろに追加の語を取る命令もある
+type opcode uint8
+
+const (
+	opConst        opcode = iota // consts[a] を積む
+	opLoad                       // 変数 refs[a] の値を積む
+	opLoadName                   // 変数 names[a] の値を積む (位置なし)
+	opLookUp                     // 複合代入 nodes[a].(*OpAgn) の変数の値を積む
+	opStore                      // 代入 nodes[a].(*Agn)。値は残す
+	opOpAgn                      // 複合代入 nodes[a].(*OpAgn)。変数の値と右辺から計算して代入する
+	opConstCheck                 // 定数 nodes[a].(*Const) を定義できるか調べる
+	opConstDef                   // 定数 nodes[a].(*Const) を定義する。値は残す
+	opPop                        // 捨てる
+	opTick                       // poss[a] の位置で1歩数える
+	opLoop                       // poss[a] の位置で中断を調べて1歩数える (繰り返しごと)
+	opOp1                        // 単項演算子 op1s[a]
+	opOp2                        // 二項演算子 op2s[a]
+	opCompare                    // 連鎖した比較 chains[a] の 次の語 番目。偽なら次の次の語へ飛ぶ (0 なら最後)
+	opJump                       // a へ飛ぶ
+	opJumpIfFalse                // 取り出して偽なら a へ飛ぶ
+	opAnd                        // 偽なら残して a へ飛ぶ。真なら捨てる
+	opOr                         // 真なら残して a へ飛ぶ。偽なら捨てる
+	opIter                       // for nodes[a].(*For) の繰り返しを始める
+	opNext                       // 次の要素を変数に束縛する。なければ繰り返しを終えて a へ飛ぶ
+	opFrame                      // 局所変数 a 個の環境を作る
+	opBind                       // 取り出した値を局所変数 a 番目に束縛する
+	opUnbind                     // 局所変数の環境を捨てる
+	opClosure                    // 無名関数 nodes[a].(*Lambda) のクロージャを積む
+	opCall                       // 関数値の呼び出し calls[a]
+	opCallUser                   // ユーザ定義関数の呼び出し apps[a]
+	opCallBuiltin                // 組み込み関数の呼び出し apps[a]
+	opTailCall                   // 末尾位置の関数値の呼び出し calls[a]。フレームを使い回す
+	opTailCallUser               // 末尾位置のユーザ定義関数の呼び出し apps[a]。フレームを使い回す
+	opList                       // a 個の値からリストを作る
+	opMap                        // 空の連想配列を積む
+	opMapSet                     // 連想配列 nodes[a].(*MapExpr) にキーと値を加える
+	opIndex                      // 添字 nodes[a].(*Index)
+	opSlice                      // 部分列 nodes[a].(*Slice)
+	opIndexAgn                   // 要素への代入 nodes[a].(*IndexAgn)
+	opReturn                     // 関数から戻る
+)
+
+// コンパイルしたバイトコード
+// 作ったあとは変更しないので、複数のゴルーチンで共有してよい
+type code struct {
+	ins    []uint32
+	consts []Value
+	names  []Variable
+	poss   []Pos
+	// 命令が参照する構文木の節 (位置や演算子など)
+	// よく実行する命令の節は型ごとの表に入れて、型アサーションをしない
+	refs   []*VarRef
+	op1s   []*Op1
+	op2s   []op2Node
+	chains []*Chain
+	calls  []*Call
+	apps   []*App
+	nodes  []Expr // その他の節
+}
+
+// 二項演算子の節
+// 数どうしの演算はコンパイルするときに op2Table から引いておく
+type op2Node struct {
+	*Op2
+	num Op2Func // nil なら数どうしの演算がない
+}
+
+func (e op2Node) apply(x, y Value) Value {
+	if e.num != nil {
+		if _, ok := x.(Num); ok {
+			if _, ok := y.(Num); ok {
+				v, err := e.num(x, y)
+				if err != nil {
+					panic(runtimeError(e.start, "%v", err))
+				}
+				return v
+			}
+		}
+	}
+	return e.Op2.apply(x, y)
+}
+
+// 構文木をバイトコードにコンパイルする
+// バイトコードは構文木と同じ順に評価し、同じエラーを返す
+// 知らない節 (Go で作った構文木など) があれば nil を返す (構文木のまま評価する)
+func compile(e Expr) *code {
+	cp := &compiler{c: &code{}}
+	return cp.compile(e)
+}
+
+// 関数の本体をコンパイルする
+// 末尾位置の呼び出しは呼び出し元に戻らずに呼び出す
+func compileBody(body Expr) *code {
+	cp := &compiler{c: &code{}, tail: true}
+	return cp.compile(body)
+}
+
+func (cp *compiler) compile(e Expr) *code {
+	cp.expr(e)
+	if cp.unknown {
+		return nil
+	}
+	cp.emit(opReturn, 0)
+	return cp.c
+}
+
+// バイトコードも式として評価できる
+func (c *code) Eval(ip *Interpreter, env *Env) Value {
+	return ip.run(c, env)
+}
+
+type compiler struct {
+	c       *code
+	tail    bool // 次にコンパイルする式が関数の本体の末尾位置にあるか
+	unknown bool // 知らない節があった
+}
+
+func (cp *compiler) emit(op opcode, a int) int {
+	if a < 0 || a >= 1<<24 {
+		panic(fmt.Errorf("operand out of range: %d", a))
+	}
+	cp.c.ins = append(cp.c.ins, uint32(op)|uint32(a)<<8)
+	return len(cp.c.ins) - 1
+}
+
+// 命令の後ろに語を加える
+func (cp *compiler) word(w int) int {
+	cp.c.ins = append(cp.c.ins, uint32(w))
+	return len(cp.c.ins) - 1
+}
+
+// 飛び先を後で決める
+func (cp *compiler) patch(at int) {
+	op := cp.c.ins[at] & 0xff
+	cp.c.ins[at] = op | uint32(len(cp.c.ins))<<8
+}
+
+func (cp *compiler) constant(v Value) int {
+	cp.c.consts = append(cp.c.consts, v)
+	return len(cp.c.consts) - 1
+}
+
+func (cp *compiler) name(v Variable) int {
+	cp.c.names = append(cp.c.names, v)
+	return len(cp.c.names) - 1
+}
+
+func (cp *compiler) node(e Expr) int {
+	cp.c.nodes = append(cp.c.nodes, e)
+	return len(cp.c.nodes) - 1
+}
+
+func (cp *compiler) ref(e *VarRef) int {
+	cp.c.refs = append(cp.c.refs, e)
+	return len(cp.c.refs) - 1
+}
+
+func (cp *compiler) op1(e *Op1) int {
+	cp.c.op1s = append(cp.c.op1s, e)
+	return len(cp.c.op1s) - 1
+}
+
+func (cp *compiler) op2(e *Op2) int {
+	num := op2Table[op2Key{e.code, NumType, NumType}]
+	cp.c.op2s = append(cp.c.op2s, op2Node{e, num})
+	return len(cp.c.op2s) - 1
+}
+
+func (cp *compiler) chain(e *Chain) int {
+	cp.c.chains = append(cp.c.chains, e)
+	return len(cp.c.chains) - 1
+}
+
+func (cp *compiler) call(e *Call) int {
+	cp.c.calls = append(cp.c.calls, e)
+	return len(cp.c.calls) - 1
+}
+
+func (cp *compiler) app(e *App) int {
+	cp.c.apps = append(cp.c.apps, e)
+	return len(cp.c.apps) - 1
+}
+
+func (cp *compiler) tick(pos Pos) {
+	cp.c.poss = append(cp.c.poss, pos)
+	cp.emit(opTick, len(cp.c.poss)-1)
+}
+
+func (cp *compiler) pos(pos Pos) int {
+	cp.c.poss = append(cp.c.poss, pos)
+	return len(cp.c.poss) - 1
+}
+
+func (cp *compiler) expr(e Expr) {
+	// 末尾位置を引き継ぐのは if の分岐、begin の最後の式、let の本体だけ
+	tail := cp.tail
+	cp.tail = false
+	switch e := e.(type) {
+	case Value:
+		cp.emit(opConst, cp.constant(e))
+	case *VarRef:
+		cp.emit(opLoad, cp.ref(e))
+	case Variable:
+		cp.emit(opLoadName, cp.name(e))
+	case *Agn:
+		cp.tick(e.start)
+		cp.expr(e.expr)
+		cp.emit(opStore, cp.node(e))
+	case *OpAgn:
+		cp.tick(e.start)
+		k := cp.node(e)
+		cp.emit(opLookUp, k)
+		cp.expr(e.expr)
+		cp.emit(opOpAgn, k)
+	case *Const:
+		cp.tick(e.start)
+		k := cp.node(e)
+		cp.emit(opConstCheck, k)
+		cp.expr(e.expr)
+		cp.emit(opConstDef, k)
+	case *Op1:
+		cp.tick(e.start)
+		cp.expr(e.expr)
+		cp.emit(opOp1, cp.op1(e))
+	case *Op2:
+		cp.tick(e.start)
+		cp.expr(e.left)
+		cp.expr(e.right)
+		cp.emit(opOp2, cp.op2(e))
+	case *Ops:
+		var op opcode
+		switch e.code {
+		case AND:
+			op = opAnd
+		case OR:
+			op = opOr
+		default:
+			panic(fmt.Errorf("invalid Ops code"))
+		}
+		cp.tick(e.start)
+		cp.expr(e.left)
+		j := cp.emit(op, 0)
+		cp.expr(e.right)
+		cp.patch(j)
+	case *Chain:
+		cp.tick(e.start)
+		k := cp.chain(e)
+		cp.expr(e.xs[0])
+		jumps := make([]int, 0, len(e.codes))
+		for i := range e.codes {
+			cp.expr(e.xs[i+1])
+			cp.emit(opCompare, k)
+			cp.word(i)
+			jumps = append(jumps, cp.word(0))
+		}
+		for _, j := range jumps[:len(jumps)-1] {
+			cp.c.ins[j] = uint32(len(cp.c.ins))
+		}
+	case *Sel:
+		cp.tick(e.start)
+		cp.expr(e.testForm)
+		j := cp.emit(opJumpIfFalse, 0)
+		cp.tail = tail
+		cp.expr(e.thenForm)
+		end := cp.emit(opJump, 0)
+		cp.patch(j)
+		cp.tail = tail
+		cp.expr(e.elseForm)
+		cp.patch(end)
+	case *Bgn:
+		if len(e.body) == 0 {
+			cp.emit(opConst, cp.constant(Num(0)))
+			return
+		}
+		for i, x := range e.body {
+			if i > 0 {
+				cp.emit(opPop, 0)
+			}
+			cp.tail = tail && i == len(e.body)-1
+			cp.expr(x)
+		}
+	case *Whl:
+		cp.tick(e.start)
+		p := cp.pos(e.start)
+		top := len(cp.c.ins)
+		cp.expr(e.testForm)
+		j := cp.emit(opJumpIfFalse, 0)
+		cp.emit(opLoop, p)
+		cp.expr(e.body)
+		cp.emit(opPop, 0)
+		cp.emit(opJump, top)
+		cp.patch(j)
+		cp.emit(opConst, cp.constant(Num(0)))
+	case *For:
+		cp.tick(e.start)
+		p := cp.pos(e.start)
+		cp.expr(e.seq)
+		cp.emit(opIter, cp.node(e))
+		top := cp.emit(opNext, 0)
+		cp.emit(opLoop, p)
+		cp.expr(e.body)
+		cp.emit(opPop, 0)
+		cp.emit(opJump, top)
+		cp.patch(top)
+		cp.emit(opConst, cp.constant(Num(0)))
+	case *Let:
+		cp.tick(e.start)
+		cp.emit(opFrame, len(e.vars))
+		for i, x := range e.vals {
+			cp.expr(x)
+			cp.emit(opBind, i)
+		}
+		cp.tail = tail
+		cp.expr(e.body)
+		cp.emit(opUnbind, 0)
+	case *Lambda:
+		cp.emit(opClosure, cp.node(e))
+	case *Call:
+		cp.tick(e.start)
+		cp.expr(e.fn)
+		for _, x := range e.xs {
+			cp.expr(x)
+		}
+		if tail {
+			cp.emit(opTailCall, cp.call(e))
+		} else {
+			cp.emit(opCall, cp.call(e))
+		}
+	case *App:
+		cp.tick(e.start)
+		for _, x := range e.xs {
+			cp.expr(x)
+		}
+		if _, ok := e.fn.(*FuncU); !ok {
+			cp.emit(opCallBuiltin, cp.app(e))
+		} else if tail {
+			cp.emit(opTailCallUser, cp.app(e))
+		} else {
+			cp.emit(opCallUser, cp.app(e))
+		}
+	case *ListExpr:
+		cp.tick(e.start)
+		for _, x := range e.elems {
+			cp.expr(x)
+		}
+		cp.emit(opList, len(e.elems))
+	case *MapExpr:
+		cp.tick(e.start)
+		cp.emit(opMap, 0)
+		k := cp.node(e)
+		for i := range e.keys {
+			cp.expr(e.keys[i])
+			cp.expr(e.vals[i])
+			cp.emit(opMapSet, k)
+		}
+	case *Index:
+		cp.tick(e.start)
+		cp.expr(e.expr)
+		cp.expr(e.index)
+		cp.emit(opIndex, cp.node(e))
+	case *Slice:
+		cp.tick(e.start)
+		cp.expr(e.expr)
+		if e.lo != nil {
+			cp.expr(e.lo)
+		}
+		if e.hi != nil {
+			cp.expr(e.hi)
+		}
+		cp.emit(opSlice, cp.node(e))
+	case *IndexAgn:
+		cp.tick(e.start)
+		cp.expr(e.target.expr)
+		cp.expr(e.target.index)
+		cp.expr(e.expr)
+		cp.emit(opIndexAgn, cp.node(e))
+	default:
+		cp.unknown = true
+	}
+}
@@ -0,0 +1,71 @@
+package lex
+
+import "text/scanner"
+
+// 定数の定義
+// const 名前 = 式
+type Const struct {
+	span
+	name Variable
+	expr Expr
+}
+
+func newConst(name Variable, expr Expr) *Const {
+	return &Const{name: name, expr: expr}
+}
+
+func makeConst(lex *Lex) Expr {
+	start := lex.tokenPos()
+	checkPolicy(start, lex.ip.Policy.NoGlobalAssign, "const")
+	lex.getToken()
+	if lex.Token != scanner.Ident {
+		panic(lex.syntaxError("const: name expected"))
+	}
+	name := Variable(lex.TokenText())
+	lex.getToken()
+	if lex.Token != '=' {
+		panic(lex.syntaxError("const: '=' expected"))
+	}
+	lex.getToken()
+	return lex.mark(newConst(name, expression(lex)), start)
+}
+
+// 定数の定義の評価
+// 定義済みの定数や大域変数と同じ名前は使えない
+func (e *Const) Eval(ip *Interpreter, env *Env) Value {
+	ip.tick(e.start)
+	e.check(ip)
+	return e.define(ip, e.expr.Eval(ip, env))
+}
+
+// 値を評価する前に名前を調べる
+func (e *Const) check(ip *Interpreter) {
+	if _, ok := ip.lookUpConst(e.name); ok {
+		panic(runtimeError(e.start, "constant %v is already defined", e.name))
+	}
+	if _, ok := ip.globalEnv[e.name]; ok {
+		panic(runtimeError(e.start, "%v is already defined as a variable", e.name))
+	}
+}
+
+func (e *Const) define(ip *Interpreter, val Value) Value {
+	ip.checkGlobals(e.start, e.name)
+	if ip.constRO {
+		consts := make(map[Variable]Value, len(ip.consts)+1)
+		for name, v := range ip.consts {
+			consts[name] = v
+		}
+		ip.consts, ip.constRO = consts, false
+	}
+	ip.consts[e.name] = val
+	return val
+}
+
+// 組み込みの定数と const で定義した定数を探す
+func (ip *Interpreter) lookUpConst(name Variable) (Value, bool) {
+	if val, ok := constTable[name]; ok {
+		return val, true
+	}
+	val, ok := ip.consts[name]
+	return val, ok
+}
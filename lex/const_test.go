@@ -0,0 +1,147 @@
+package lex
+
+import (
+	"math"
+	"testing"
+)
+
+func TestConst(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    Value
+		wantErr bool
+	}{
+		{
+			name: "tau",
+			src:  "tau / pi",
+			want: Num(2),
+		},
+		{
+			name: "physical constant",
+			src:  "h * c",
+			want: Num(6.62607015e-34 * 299792458),
+		},
+		{
+			name: "variable shadows physical constant",
+			src:  "c = 5; c * 2",
+			want: Num(10),
+		},
+		{
+			name: "user constant shadows physical constant",
+			src:  "const R = 1; R + 1",
+			want: Num(2),
+		},
+		{
+			name: "assign to physical constant",
+			src:  "c = 3; c",
+			want: Num(3),
+		},
+		{
+			name:    "assign to builtin constant",
+			src:     "pi = 3",
+			wantErr: true,
+		},
+		{
+			name: "local shadows constant",
+			src:  "def f(c) c = c + 1 end f(1)",
+			want: Num(2),
+		},
+		{
+			name: "user constant",
+			src:  "const r = 2; pi * r * r",
+			want: Num(4 * math.Pi),
+		},
+		{
+			name: "user constant in function",
+			src:  "const rate = 0.1; def tax(x) x * rate end tax(50)",
+			want: Num(5),
+		},
+		{
+			name:    "assign to user constant",
+			src:     "const r = 2; r = 3",
+			wantErr: true,
+		},
+		{
+			name:    "assign to user constant in function",
+			src:     "const r = 2; def f() r = 3 end f()",
+			wantErr: true,
+		},
+		{
+			name:    "redefine constant",
+			src:     "const r = 2; const r = 3",
+			wantErr: true,
+		},
+		{
+			name:    "redefine builtin constant",
+			src:     "const e = 3",
+			wantErr: true,
+		},
+		{
+			name:    "constant named as variable",
+			src:     "x = 1; const x = 2",
+			wantErr: true,
+		},
+		{
+			name:    "const is a statement",
+			src:     "1 + const x = 2",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := evalString(tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("Eval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// const で定義した定数は複製したインタプリタと Program に引き継ぐ
+func TestConst_Clone(t *testing.T) {
+	ip := NewInterpreter()
+	run(ip, "const k = 3; quit")
+	if got := Variable("k").Eval(ip.Clone(), nil); got != Num(3) {
+		t.Errorf("Clone: k = %v, want 3", got)
+	}
+	p, err := ip.Compile("const m = 2; k * m * a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if got, err := p.Run(map[string]float64{"a": 5}); err != nil || got != Num(30) {
+			t.Errorf("Run() = %v, %v, want 30", got, err)
+		}
+	}
+	if _, ok := ip.consts["m"]; ok {
+		t.Errorf("Run() defined m in the interpreter")
+	}
+	if got := p.FreeVars(); len(got) != 1 || got[0] != "a" {
+		t.Errorf("FreeVars() = %v, want [a]", got)
+	}
+	ip.Reset()
+	if _, ok := ip.consts["k"]; ok {
+		t.Errorf("Reset() left constant k")
+	}
+}
+
+// 外から与えた変数は物理定数より優先する
+func TestConst_Physical(t *testing.T) {
+	p, err := Compile("c * 2 + R")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.FreeVars(); len(got) != 2 || got[0] != "R" || got[1] != "c" {
+		t.Errorf("FreeVars() = %v, want [R c]", got)
+	}
+	if got, err := p.Run(map[string]float64{"c": 10, "R": 1}); err != nil || got != Num(21) {
+		t.Errorf("Run() = %v, %v, want 21", got, err)
+	}
+	if got, err := p.Run(nil); err != nil || got != Num(299792458*2+8.314462618) {
+		t.Errorf("Run(nil) = %v, %v, want %v", got, err, 299792458*2+8.314462618)
+	}
+}
@@ -0,0 +1,259 @@
+package lex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// quit が入力されたことを表す
+var ErrQuit = errors.New("quit")
+
+// 構文エラー
+type SyntaxError struct {
+	Pos Pos
+	Msg string
+}
+
+// 現在のトークンの位置で構文エラーを作る
+func (lex *Lex) syntaxError(format string, a ...interface{}) *SyntaxError {
+	return &SyntaxError{lex.tokenPos(), fmt.Sprintf(format, a...)}
+}
+
+func (e *SyntaxError) Error() string {
+	return posMessage(e.Pos, e.Msg)
+}
+
+func (e *SyntaxError) Position() Pos {
+	return e.Pos
+}
+
+// 未定義の変数を参照した
+type UnboundVariableError struct {
+	Pos  Pos
+	Name Variable
+}
+
+func (e *UnboundVariableError) Error() string {
+	return posMessage(e.Pos, fmt.Sprintf("unbound variable: %v", e.Name))
+}
+
+func (e *UnboundVariableError) Position() Pos {
+	return e.Pos
+}
+
+// 関数の引数の個数が合わない
+type ArityError struct {
+	Pos       Pos
+	Name      string
+	Want, Got int
+	Variadic  bool // Want 個以上
+}
+
+func (e *ArityError) Error() string {
+	want := fmt.Sprint(e.Want)
+	if e.Variadic {
+		want = "at least " + want
+	}
+	return posMessage(e.Pos, fmt.Sprintf("wrong number of arguments: %v (want %v, got %d)", e.Name, want, e.Got))
+}
+
+func (e *ArityError) Position() Pos {
+	return e.Pos
+}
+
+// 関数の呼び出しが深くなりすぎた
+type RecursionError struct {
+	Pos   Pos
+	Chain []string // 外側から順に並べた呼び出しの連鎖
+}
+
+func (e *RecursionError) Error() string {
+	names := make([]string, len(e.Chain))
+	for i, name := range e.Chain {
+		if name == "" {
+			name = "fn"
+		}
+		names[i] = name
+	}
+	// 長い連鎖は最初と最後だけを表示する
+	if len(names) > 8 {
+		names = append(append(names[:3:3], "..."), names[len(names)-5:]...)
+	}
+	msg := fmt.Sprintf("maximum recursion depth exceeded (%d calls): %v",
+		len(e.Chain), strings.Join(names, " -> "))
+	return posMessage(e.Pos, msg)
+}
+
+func (e *RecursionError) Position() Pos {
+	return e.Pos
+}
+
+// 資源の上限 (Limits) を超えた
+type LimitError struct {
+	Pos   Pos
+	Limit string      // "steps", "nodes", "nesting", "globals", "functions", "timeout"
+	Max   interface{} // 上限の値
+}
+
+func (e *LimitError) Error() string {
+	return posMessage(e.Pos, fmt.Sprintf("limit exceeded: %v (max %v)", e.Limit, e.Max))
+}
+
+func (e *LimitError) Position() Pos {
+	return e.Pos
+}
+
+// Policy で許されていない構文を使った
+type PolicyError struct {
+	Pos  Pos
+	What string // 使おうとした構文
+}
+
+func (e *PolicyError) Error() string {
+	return posMessage(e.Pos, "not allowed: "+e.What)
+}
+
+func (e *PolicyError) Position() Pos {
+	return e.Pos
+}
+
+// 評価が中断された
+// Err は取り消された context のエラー (context.Canceled など)
+type InterruptError struct {
+	Pos Pos
+	Err error
+}
+
+func (e *InterruptError) Error() string {
+	msg := "interrupted"
+	if !errors.Is(e.Err, context.Canceled) {
+		msg = "interrupted: " + e.Err.Error()
+	}
+	return posMessage(e.Pos, msg)
+}
+
+func (e *InterruptError) Unwrap() error {
+	return e.Err
+}
+
+func (e *InterruptError) Position() Pos {
+	return e.Pos
+}
+
+// 登録した関数が error を返した
+type FuncError struct {
+	Pos  Pos
+	Name string
+	Err  error
+}
+
+func (e *FuncError) Error() string {
+	return posMessage(e.Pos, e.Name+": "+e.Err.Error())
+}
+
+func (e *FuncError) Unwrap() error {
+	return e.Err
+}
+
+func (e *FuncError) Position() Pos {
+	return e.Pos
+}
+
+// 処理系の誤りなどで起きた Go の実行時エラー (範囲外の添字など)
+// 計算のエラーと区別できるように包み、原因を調べられるように panic したときのスタックを持つ
+type InternalError struct {
+	Err   runtime.Error
+	Stack []byte
+}
+
+func (e *InternalError) Error() string {
+	return "internal error: " + e.Err.Error()
+}
+
+func (e *InternalError) Unwrap() error {
+	return e.Err
+}
+
+// 評価中のエラー
+type RuntimeError struct {
+	Pos Pos
+	Msg string
+}
+
+func runtimeError(pos Pos, format string, a ...interface{}) *RuntimeError {
+	return &RuntimeError{pos, fmt.Sprintf(format, a...)}
+}
+
+func (e *RuntimeError) Error() string {
+	return posMessage(e.Pos, e.Msg)
+}
+
+func (e *RuntimeError) Position() Pos {
+	return e.Pos
+}
+
+// 位置のない実行時エラーに pos を付ける
+// 組み込み関数などを呼ぶところで defer する
+func locate(pos Pos) {
+	if r := recover(); r != nil {
+		setPos(r, pos)
+		panic(r)
+	}
+}
+
+// panic で送られたエラー r に位置がなければ pos にする
+func setPos(r interface{}, pos Pos) {
+	var p *Pos
+	switch e := r.(type) {
+	case *RuntimeError:
+		p = &e.Pos
+	case *ArityError:
+		p = &e.Pos
+	case *RecursionError:
+		p = &e.Pos
+	case *LimitError:
+		p = &e.Pos
+	case *InterruptError:
+		p = &e.Pos
+	case *FuncError:
+		p = &e.Pos
+	}
+	if p != nil && !p.IsValid() {
+		*p = pos
+	}
+}
+
+// エラーメッセージにソースの該当行とキャレットを付ける
+func FormatError(err error) string {
+	var p positioner
+	if !errors.As(err, &p) {
+		return err.Error()
+	}
+	c, ok := p.Position().caret()
+	if !ok {
+		return err.Error()
+	}
+	return err.Error() + "\n" + c
+}
+
+// 構文解析と評価は内部ではpanicでエラーを伝えるので、
+// 公開するAPIの境界でerrorに戻す
+func catch(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	switch e := r.(type) {
+	case runtime.Error:
+		// recover した時点ではまだ panic した位置のスタックが残っている
+		*err = &InternalError{e, debug.Stack()}
+	case error:
+		*err = e
+	default:
+		*err = fmt.Errorf("%v", e)
+	}
+}
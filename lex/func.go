@@ -1,7 +1,6 @@
 package lex
 
 import (
-	"fmt"
 	"text/scanner"
 )
 
@@ -10,59 +9,150 @@ type FuncU struct {
 	name string
 	xs   []Variable
 	body Expr
+	code *code      // body をコンパイルしたもの
+	memo *memoTable // memo def で定義したなら覚えておいた結果
 }
 
 func newFuncU(name string, xs []Variable, body Expr) *FuncU {
-	return &FuncU{name, xs, body}
+	f := &FuncU{name: name, xs: xs}
+	if body != nil {
+		f.setBody(body)
+	}
+	return f
+}
+
+// 本体を設定する
+// バイトコードでも評価できるように、ここでコンパイルしておく
+func (f *FuncU) setBody(body Expr) {
+	f.body = body
+	f.code = compileBody(body)
+}
+
+// 結果を覚えるかどうかを設定する
+// 定義し直したら覚えておいた結果は捨てる
+func (f *FuncU) setMemo(memo bool) {
+	f.memo = nil
+	if memo {
+		f.memo = newMemoTable()
+	}
 }
 
 func (f *FuncU) Argc() int {
 	return len(f.xs)
 }
 
-// ユーザ関数の定義
-func defineFunc(lex *Lex) {
+// ユーザ関数の定義 (memo def なら結果を覚える関数)
+// 定義した関数名を返す
+func defineFunc(lex *Lex) string {
+	checkPolicy(lex.tokenPos(), lex.ip.Policy.NoDef, "def")
+	memo := lex.Token == MEMO
+	if memo {
+		lex.getToken()
+		if lex.Token != DEF {
+			panic(lex.syntaxError("'def' expected"))
+		}
+	}
 	lex.getToken()
 	if lex.Token != scanner.Ident {
-		panic(fmt.Errorf("invalid define form"))
+		panic(lex.syntaxError("invalid define form"))
 	}
 	name := lex.TokenText()
+	pos := lex.tokenPos()
 	lex.getToken()
 	xs := getParameter(lex)
-	v, ok := funcTable[name]
+	defineBody(lex, pos, name, xs, memo)
+	return name
+}
+
+// 関数の本体を読み込んで関数表に登録する
+// 宣言や定義済みの関数なら本体を置き換える
+// memo なら大域変数を読み書きしないことを確かめて、結果を覚える関数にする
+func defineBody(lex *Lex, pos Pos, name string, xs []Variable, memo bool) {
+	scope := lex.pushLocals(xs...)
+	defer lex.popLocals(scope)
+	v, ok := lex.ip.funcTable[name]
 	if ok {
 		switch f := v.(type) {
 		case *FuncU:
 			if len(f.xs) != len(xs) {
-				panic(fmt.Errorf("wrong number of arguments %v", name))
+				panic(&ArityError{Pos: pos, Name: name, Want: len(f.xs), Got: len(xs)})
 			}
-			body := newBgn([]Expr{expression(lex)})
+			body := Expr(newBgn([]Expr{expression(lex)}))
 			if lex.Token != END {
-				panic(fmt.Errorf("'end' expected"))
+				panic(lex.syntaxError("'end' expected"))
+			}
+			body = lex.ip.optimize(body)
+			if memo {
+				if err := lex.ip.checkPure(f, body); err != nil {
+					panic(err)
+				}
 			}
 			f.xs = xs
-			f.body = body
+			f.setBody(body)
+			f.setMemo(memo)
 		default:
-			panic(fmt.Errorf("%v is build-in function", name))
+			panic(&SyntaxError{pos, name + " is build-in function"})
 		}
 	} else {
 		// 再帰呼び出し対応
+		lex.ip.checkFuncs(pos)
 		f := newFuncU(name, xs, nil)
-		funcTable[name] = f
-		f.body = newBgn([]Expr{expression(lex)})
+		lex.ip.funcTable[name] = f
+		body := Expr(newBgn([]Expr{expression(lex)}))
 		if lex.Token != END {
-			delete(funcTable, name)
-			panic(fmt.Errorf("'end' expected"))
+			delete(lex.ip.funcTable, name)
+			panic(lex.syntaxError("'end' expected"))
 		}
+		body = lex.ip.optimize(body)
+		if memo {
+			if err := lex.ip.checkPure(f, body); err != nil {
+				delete(lex.ip.funcTable, name)
+				panic(err)
+			}
+		}
+		f.setBody(body)
+		f.setMemo(memo)
 	}
-	fmt.Println(name)
+	lex.ip.resetMemo()
+}
+
+// 関数の宣言 (declare name(args);)
+// 本体は後の def で与える。相互再帰する関数を先に宣言しておくと
+// 定義より前の呼び出しでも引数の個数を検査できる
+func declareFunc(lex *Lex) string {
+	checkPolicy(lex.tokenPos(), lex.ip.Policy.NoDef, "declare")
+	lex.getToken()
+	if lex.Token != scanner.Ident {
+		panic(lex.syntaxError("invalid declare form"))
+	}
+	name := lex.TokenText()
+	pos := lex.tokenPos()
+	lex.getToken()
+	xs := getParameter(lex)
+	if lex.Token != ';' {
+		panic(lex.syntaxError("';' expected"))
+	}
+	v, ok := lex.ip.funcTable[name]
+	if !ok {
+		lex.ip.checkFuncs(pos)
+		lex.ip.funcTable[name] = newFuncU(name, xs, nil)
+		return name
+	}
+	f, ok := v.(*FuncU)
+	if !ok {
+		panic(&SyntaxError{pos, name + " is build-in function"})
+	}
+	if len(f.xs) != len(xs) {
+		panic(&ArityError{Pos: pos, Name: name, Want: len(f.xs), Got: len(xs)})
+	}
+	return name
 }
 
 // 仮引数の取得
 func getParameter(lex *Lex) []Variable {
 	e := make([]Variable, 0)
 	if lex.Token != '(' {
-		panic(fmt.Errorf("'(' expected"))
+		panic(lex.syntaxError("'(' expected"))
 	}
 	lex.getToken()
 	if lex.Token == ')' {
@@ -80,10 +170,113 @@ func getParameter(lex *Lex) []Variable {
 			case ',':
 				lex.getToken()
 			default:
-				panic(fmt.Errorf("unexpected token in parameter list"))
+				panic(lex.syntaxError("unexpected token in parameter list"))
 			}
 		} else {
-			panic(fmt.Errorf("unexpected token in parameter list"))
+			panic(lex.syntaxError("unexpected token in parameter list"))
+		}
+	}
+}
+
+// 無名関数 fn(x, ...) 本体 end
+type Lambda struct {
+	span
+	fn *FuncU
+}
+
+func newLambda(fn *FuncU) *Lambda {
+	return &Lambda{fn: fn}
+}
+
+// 評価したときの環境を捕まえたクロージャを作る
+func (e *Lambda) Eval(ip *Interpreter, env *Env) Value {
+	ip.tick(e.start)
+	return &FuncVal{fn: e.fn, env: env}
+}
+
+// 無名関数の処理
+func makeLambda(lex *Lex) Expr {
+	xs := getParameter(lex)
+	scope := lex.pushLocals(xs...)
+	body := newBgn([]Expr{expression(lex)})
+	lex.popLocals(scope)
+	if lex.Token != END {
+		panic(lex.syntaxError("'end' expected"))
+	}
+	lex.getToken()
+	return newLambda(newFuncU("", xs, body))
+}
+
+// 関数呼び出し f(x, ...)
+// 呼び出す関数は評価したときに決まる
+type Call struct {
+	span
+	fn Expr
+	xs []Expr
+}
+
+func newCall(fn Expr, xs []Expr) *Call {
+	return &Call{fn: fn, xs: xs}
+}
+
+func (e *Call) Eval(ip *Interpreter, env *Env) Value {
+	ip.tick(e.start)
+	v := e.fn.Eval(ip, env)
+	xs := make([]Value, len(e.xs))
+	for i, x := range e.xs {
+		xs[i] = x.Eval(ip, env)
+	}
+	defer locate(e.start)
+	return ip.call(toFunc(v), xs)
+}
+
+// 関数値 v を args で呼び出す準備
+// ユーザ定義関数なら関数と引数の環境 (args を複製する) を返し、
+// 組み込み関数なら呼び出した値を返す (エラーは e の位置にする)
+func (e *Call) prepare(ip *Interpreter, v Value, args []Value) (*FuncU, *Env, Value) {
+	defer locate(e.start)
+	f := toFunc(v)
+	checkArity(f, len(args))
+	if u, ok := f.fn.(*FuncU); ok {
+		env := makeEnv(len(args), f.env)
+		copy(env.vals, args)
+		return u, env, nil
+	}
+	return nil, nil, ip.callBuiltinArgs(f.fn, args)
+}
+
+// バイトコードで関数値 v を呼び出す準備
+// ユーザ定義関数なら関数に入る
+func (e *Call) enter(ip *Interpreter, v Value, args []Value) (*FuncU, *Env, Value) {
+	f, env, r := e.prepare(ip, v, args)
+	if f == nil {
+		return nil, nil, r
+	}
+	defer locate(e.start)
+	return ip.enterCall(Pos{}, f), env, nil
+}
+
+// 関数を引数に取る組み込み関数
+func initHigherOrderFunc() {
+	builtinTable["integrate"] = FuncV{3, false, integrate}
+}
+
+// integrate(f, a, b): シンプソン則による f の a から b までの定積分
+func integrate(ip *Interpreter, xs []Value) Value {
+	const n = 1000 // 分割数 (偶数)
+	f := toFunc(xs[0])
+	a, b := toNum(xs[1]), toNum(xs[2])
+	at := func(x float64) float64 {
+		return toNum(ip.call(f, []Value{Num(x)}))
+	}
+	h := (b - a) / n
+	s := at(a) + at(b)
+	for i := 1; i < n; i++ {
+		if i%2 == 1 {
+			s += 4 * at(a+float64(i)*h)
+		} else {
+			s += 2 * at(a+float64(i)*h)
 		}
 	}
+	return Num(s * h / 3)
 }
@@ -0,0 +1,164 @@
+package lex
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestLambda(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    Value
+		wantErr bool
+	}{
+		{
+			name: "call through variable",
+			src:  "sq = fn(x) x * x end; sq(4)",
+			want: Num(16),
+		},
+		{
+			name: "immediate call",
+			src:  "(fn(x, y) x - y end)(5, 3)",
+			want: Num(2),
+		},
+		{
+			name: "capture global",
+			src:  "k = 3; f = fn(x) x * k end; k = 4; f(2)",
+			want: Num(8),
+		},
+		{
+			name: "capture local",
+			src:  "def adder(n) fn(x) x + n end end add5 = adder(5); add5(10)",
+			want: Num(15),
+		},
+		{
+			name: "counter",
+			src:  "let c = 0 in let inc = fn() c = c + 1 end in inc(), inc(), c end end",
+			want: Num(2),
+		},
+		{
+			name: "argument",
+			src:  "def twice(g, x) g(g(x)) end twice(fn(x) x * 10 end, 2)",
+			want: Num(200),
+		},
+		{
+			name: "builtin as value",
+			src:  "f = sqrt; f(9)",
+			want: Num(3),
+		},
+		{
+			name: "map with lambda",
+			src:  "k = 2; map(fn(x) x * k end, [1, 2, 3])",
+			want: nums(2, 4, 6),
+		},
+		{
+			name: "list of functions",
+			src:  "fs = [fn(x) x + 1 end, fn(x) x * 2 end]; fs[1](fs[0](3))",
+			want: Num(8),
+		},
+		{
+			name:    "call number",
+			src:     "x = 1; x(2)",
+			wantErr: true,
+		},
+		{
+			name:    "wrong arity",
+			src:     "f = fn(x) x end; f(1, 2)",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := evalString(tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Eval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMutualRecursion(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    Value
+		wantErr bool
+	}{
+		{
+			name: "forward reference",
+			src: "def even(n) if n == 0 then true else odd(n - 1) end end " +
+				"def odd(n) if n == 0 then false else even(n - 1) end end " +
+				"even(10)",
+			want: Bool(true),
+		},
+		{
+			name: "declare",
+			src: "declare odd(n); " +
+				"def even(n) if n == 0 then true else odd(n - 1) end end " +
+				"def odd(n) if n == 0 then false else even(n - 1) end end " +
+				"odd(7)",
+			want: Bool(true),
+		},
+		{
+			name: "declare twice",
+			src:  "declare f(x); declare f(y); def f(x) x + 1 end f(1)",
+			want: Num(2),
+		},
+		{
+			name:    "declared but not defined",
+			src:     "declare g(x); def f(x) g(x) end f(1)",
+			wantErr: true,
+		},
+		{
+			name:    "arity mismatch on definition",
+			src:     "declare g(x); def g(x, y) x end 0",
+			wantErr: true,
+		},
+		{
+			name:    "arity mismatch on declaration",
+			src:     "declare g(x); declare g(x, y); 0",
+			wantErr: true,
+		},
+		{
+			name:    "arity mismatch on call",
+			src:     "declare g(x); def f(x) g(x, 1) end 0",
+			wantErr: true,
+		},
+		{
+			name:    "late call with wrong arity",
+			src:     "def f(x) g(x, 1) end def g(x) x end f(1)",
+			wantErr: true,
+		},
+		{
+			name:    "declare builtin",
+			src:     "declare sqrt(x); 0",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := evalString(tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Eval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_integrate(t *testing.T) {
+	got, err := evalString("integrate(fn(x) sin(x) end, 0, 3.141592653589793)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(float64(got.(Num))-2) > 1e-9 {
+		t.Errorf("integrate() = %v, want 2", got)
+	}
+}
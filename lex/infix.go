@@ -0,0 +1,321 @@
+package lex
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/scanner"
+)
+
+// 二項演算子の結合性
+type Assoc int
+
+const (
+	Left     Assoc = iota // 左結合 (a - b - c は (a - b) - c)
+	Right                 // 右結合 (a ^ b ^ c は a ^ (b ^ c))
+	NonAssoc              // 結合しない (a op b op c は構文エラー)
+	chain                 // 比較の連鎖 (a < b < c は a < b and b < c)
+)
+
+// 組み込みの二項演算子の優先順位 (大きいほど強く結合する)
+// 単項演算子は precMul と precPower の間になる
+const (
+	precLogic   = iota // and or
+	precCompare        // == != < > <= >=
+	precBitOr          // |
+	precBitXor         // xor
+	precBitAnd         // &
+	precShift          // << >>
+	precAdd            // + -
+	precMul            // * / // %
+	precPower          // ^
+	maxPrec            // 定義できる優先順位の上限
+)
+
+// 演算子に使える記号
+const opChars = "+-*/%^<>=!&|~@$?:"
+
+func isOpChar(c rune) bool {
+	return c >= 0 && strings.ContainsRune(opChars, c)
+}
+
+// 二項演算子
+type Infix struct {
+	Prec  int   // 優先順位
+	Assoc Assoc // 結合性
+	name  string
+	code  rune // トークン
+	user  bool // true なら関数表の name の関数を呼び出す
+}
+
+// 構文木を作る
+func (op *Infix) node(lex *Lex, left, right Expr) Expr {
+	switch {
+	case op.user:
+		return newApp(lex.ip.funcTable[op.name], []Expr{left, right})
+	case op.code == AND || op.code == OR:
+		return newOps(op.code, left, right)
+	default:
+		return newOp2(op.code, left, right)
+	}
+}
+
+// 演算子表
+// 字句解析は tokens にある綴りのうち最も長いものを1つのトークンにする
+type operators struct {
+	tokens map[string]rune // 綴り → トークン
+	prefix map[string]bool // 綴りの接頭辞
+	infix  map[rune]*Infix // トークン → 二項演算子
+	next   rune            // 次に定義する演算子のトークン
+}
+
+// 定義した演算子のトークン (キーワードや text/scanner のトークンと重ならない)
+const userOpBase = -1000
+
+func newOperators() *operators {
+	return &operators{
+		tokens: make(map[string]rune),
+		prefix: make(map[string]bool),
+		infix:  make(map[rune]*Infix),
+		next:   userOpBase,
+	}
+}
+
+// 組み込みの演算子表
+// 初期化後は読み出し専用で、各インタプリタはこれを複製して使う
+var builtinOperators = newOperators()
+
+func init() {
+	ops := builtinOperators
+	for name, code := range map[string]rune{
+		"!": NOT, "=": '=', "==": EQ, "!=": NE, "<": LT, ">": GT, "<=": LE, ">=": GE,
+		"<<": SHL, ">>": SHR, "**": '^', "//": IDIV,
+		"+=": ADDAGN, "-=": SUBAGN, "*=": MULAGN, "/=": DIVAGN,
+	} {
+		ops.addToken(name, code)
+	}
+	for _, op := range []*Infix{
+		{precLogic, Left, "and", AND, false},
+		{precLogic, Left, "or", OR, false},
+		{precCompare, chain, "==", EQ, false},
+		{precCompare, chain, "!=", NE, false},
+		{precCompare, chain, "<", LT, false},
+		{precCompare, chain, ">", GT, false},
+		{precCompare, chain, "<=", LE, false},
+		{precCompare, chain, ">=", GE, false},
+		{precBitOr, Left, "|", '|', false},
+		{precBitXor, Left, "xor", XOR, false},
+		{precBitAnd, Left, "&", '&', false},
+		{precShift, Left, "<<", SHL, false},
+		{precShift, Left, ">>", SHR, false},
+		{precAdd, Left, "+", '+', false},
+		{precAdd, Left, "-", '-', false},
+		{precMul, Left, "*", '*', false},
+		{precMul, Left, "/", '/', false},
+		{precMul, Left, "//", IDIV, false},
+		{precMul, Left, "%", '%', false},
+		{precPower, Right, "^", '^', false},
+	} {
+		ops.infix[op.code] = op
+	}
+}
+
+func (ops *operators) addToken(name string, code rune) {
+	ops.tokens[name] = code
+	for i := 1; i <= len(name); i++ {
+		ops.prefix[name[:i]] = true
+	}
+}
+
+func (ops *operators) clone() *operators {
+	c := newOperators()
+	c.next = ops.next
+	for name, code := range ops.tokens {
+		c.tokens[name] = code
+	}
+	for s := range ops.prefix {
+		c.prefix[s] = true
+	}
+	for code, op := range ops.infix {
+		x := *op
+		c.infix[code] = &x
+	}
+	return c
+}
+
+// 組み込みの演算子か (':' は連想配列で使う)
+func isBuiltinOp(name string) bool {
+	if _, ok := builtinOperators.tokens[name]; ok {
+		return true
+	}
+	return len(name) == 1 && strings.Contains("+-*/%^&|~:", name)
+}
+
+// 二項演算子を定義する (定義済みなら優先順位と結合性を変える)
+func (ops *operators) define(name string, prec int, assoc Assoc) error {
+	if err := checkInfix(name, prec, assoc); err != nil {
+		return err
+	}
+	if code, ok := ops.tokens[name]; ok {
+		op := ops.infix[code]
+		op.Prec, op.Assoc = prec, assoc
+		return nil
+	}
+	code := ops.next
+	ops.next--
+	ops.addToken(name, code)
+	ops.infix[code] = &Infix{prec, assoc, name, code, true}
+	return nil
+}
+
+// 定義した演算子を取り除く
+func (ops *operators) remove(name string) {
+	code := ops.tokens[name]
+	delete(ops.tokens, name)
+	delete(ops.infix, code)
+	// 接頭辞は作り直す
+	ops.prefix = make(map[string]bool)
+	for s := range ops.tokens {
+		ops.addToken(s, ops.tokens[s])
+	}
+}
+
+// 定義できる演算子か
+func checkInfix(name string, prec int, assoc Assoc) error {
+	if name == "" {
+		return fmt.Errorf("operator expected")
+	}
+	for _, c := range name {
+		if !isOpChar(c) {
+			return fmt.Errorf("invalid operator %v", name)
+		}
+	}
+	if isBuiltinOp(name) {
+		return fmt.Errorf("%v is build-in operator", name)
+	}
+	if prec < 0 || prec > maxPrec {
+		return fmt.Errorf("precedence of %v must be 0 to %v", name, maxPrec)
+	}
+	if assoc < Left || assoc > NonAssoc {
+		return fmt.Errorf("invalid associativity of %v", name)
+	}
+	return nil
+}
+
+// 演算子表 (インタプリタがなければ組み込みの演算子だけ)
+func (lex *Lex) operators() *operators {
+	if lex.ip == nil {
+		return builtinOperators
+	}
+	return lex.ip.ops
+}
+
+// 記号が続く間、演算子表の綴りの接頭辞になる限り読んで1つのトークンにする
+// 途中で綴りに一致しなくなっても戻らないので、演算子の間には空白を入れる
+func (lex *Lex) scanOperator() {
+	ops := lex.operators()
+	s := string(lex.Token)
+	// Next はトークンの位置を無効にするので残しておく
+	pos := lex.Position
+	for c := lex.Peek(); isOpChar(c) && ops.prefix[s+string(c)]; c = lex.Peek() {
+		s += string(lex.Next())
+	}
+	lex.Position = pos
+	if code, ok := ops.tokens[s]; ok {
+		lex.Token = code
+		lex.opText = s
+	} else if len(s) > 1 {
+		panic(lex.syntaxError("unknown operator %v", s))
+	}
+}
+
+// 現在のトークンの綴り
+func (lex *Lex) tokenText() string {
+	if lex.opText != "" {
+		return lex.opText
+	}
+	return lex.TokenText()
+}
+
+// 結合性の名前
+var assocNames = map[string]Assoc{
+	"left":  Left,
+	"right": Right,
+	"none":  NonAssoc,
+}
+
+// 演算子の定義
+// infix 優先順位 結合性 演算子 (左, 右) 本体 end
+// 定義した演算子を返す
+func defineInfix(lex *Lex) string {
+	checkPolicy(lex.tokenPos(), lex.ip.Policy.NoDef, "infix")
+	lex.getToken()
+	if lex.Token != scanner.Int {
+		panic(lex.syntaxError("precedence expected"))
+	}
+	prec, _ := strconv.Atoi(lex.TokenText())
+	lex.getToken()
+	assoc, ok := assocNames[lex.TokenText()]
+	if lex.Token != scanner.Ident || !ok {
+		panic(lex.syntaxError("'left', 'right' or 'none' expected"))
+	}
+	// 定義する前の演算子は字句解析できないので記号を直接読む
+	for c := lex.Peek(); c == ' ' || c == '\t' || c == '\r' || c == '\n'; c = lex.Peek() {
+		lex.Next()
+	}
+	pos := Pos{lex.Pos(), lex.src}
+	var b strings.Builder
+	for isOpChar(lex.Peek()) {
+		b.WriteRune(lex.Next())
+	}
+	name := b.String()
+	ops := lex.ip.ops
+	_, defined := ops.tokens[name]
+	if f, ok := lex.ip.funcTable[name]; ok {
+		if _, ok := f.(*FuncU); !ok {
+			panic(&SyntaxError{pos, name + " is build-in operator"})
+		}
+	}
+	if err := ops.define(name, prec, assoc); err != nil {
+		panic(&SyntaxError{pos, err.Error()})
+	}
+	if !defined {
+		// 誤りで定義できなければ演算子も取り除く
+		defer func() {
+			if r := recover(); r != nil {
+				ops.remove(name)
+				delete(lex.ip.funcTable, name)
+				panic(r)
+			}
+		}()
+	}
+	lex.getToken()
+	xs := getParameter(lex)
+	if len(xs) != 2 {
+		panic(lex.syntaxError("operator %v takes 2 parameters", name))
+	}
+	defineBody(lex, pos, name, xs, false)
+	return name
+}
+
+// Go の関数を二項演算子として定義する
+// op は記号 (+-*/%^<>=!&|~@$?:) を並べた組み込みでない綴り、prec は 0 から 9 の優先順位。
+// fn は Register と同じ形の2つの引数を取る関数。
+// 組み込みの演算子の優先順位は and, or が 0、比較が 1、| が 2、xor が 3、& が 4、
+// シフトが 5、+ - が 6、* / // % が 7、^ が 8 (右結合)
+func (ip *Interpreter) DefineInfix(op string, prec int, assoc Assoc, fn interface{}) error {
+	f, err := wrapFunc(op, fn)
+	if err != nil {
+		return err
+	}
+	if !arityOK(f, 2) {
+		return fmt.Errorf("infix %q: function must take 2 arguments", op)
+	}
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	if err := ip.ops.define(op, prec, assoc); err != nil {
+		return fmt.Errorf("infix %q: %v", op, err)
+	}
+	ip.funcTable[op] = f
+	return nil
+}
@@ -0,0 +1,177 @@
+package lex
+
+import (
+	"testing"
+)
+
+func TestInfix(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    Value
+		wantErr bool
+	}{
+		{
+			name: "user operator",
+			src:  "infix 6 left <+> (a, b) a*b + a + b end 2 <+> 3",
+			want: Num(11),
+		},
+		{
+			name: "precedence below multiplication",
+			src:  "infix 6 left <+> (a, b) a*b + a + b end 1 <+> 2 * 3",
+			want: Num(13),
+		},
+		{
+			name: "left associative",
+			src:  "infix 6 left -- (a, b) a - b end 10 -- 3 -- 2",
+			want: Num(5),
+		},
+		{
+			name: "right associative",
+			src:  "infix 6 right -- (a, b) a - b end 10 -- 3 -- 2",
+			want: Num(9),
+		},
+		{
+			name:    "not associative",
+			src:     "infix 1 none =~ (a, b) abs(a - b) < 0.01 end 1 =~ 1 =~ 1",
+			wantErr: true,
+		},
+		{
+			name: "binds tighter than power",
+			src:  "infix 9 left @ (a, b) a + b end 2 ^ 1 @ 1",
+			want: Num(4),
+		},
+		{
+			name: "recursive operator",
+			src:  "infix 7 left <*> (n, k) if k == 0 then 1 else n * (n <*> (k - 1)) end end 2 <*> 10",
+			want: Num(1024),
+		},
+		{
+			name: "redefine",
+			src:  "infix 6 left <> (a, b) a end infix 6 left <> (a, b) b end 1 <> 2",
+			want: Num(2),
+		},
+		{
+			name: "longest match",
+			src:  "infix 6 left <=> (a, b) sign(a - b) end [1 <=> 2, 1 <= 2]",
+			want: newList([]Value{Num(-1), Bool(true)}),
+		},
+		{
+			name:    "undefined prefix",
+			src:     "infix 6 left <+> (a, b) a end 1 <+ 2",
+			wantErr: true,
+		},
+		{
+			name:    "builtin operator",
+			src:     "infix 6 left + (a, b) a end 1",
+			wantErr: true,
+		},
+		{
+			name:    "precedence out of range",
+			src:     "infix 10 left @ (a, b) a end 1",
+			wantErr: true,
+		},
+		{
+			name:    "one parameter",
+			src:     "infix 6 left @ (a) a end 1",
+			wantErr: true,
+		},
+		{
+			name: "chained comparison",
+			src:  "1 < 2 <= 2 < 3",
+			want: Bool(true),
+		},
+		{
+			name: "chained comparison is false",
+			src:  "3 > 2 > 2",
+			want: Bool(false),
+		},
+		{
+			name: "chain evaluates middle once",
+			src:  "n = 0; def f() begin n = n + 1, 2 end end 1 < f() < 3 and n == 1",
+			want: Bool(true),
+		},
+		{
+			name: "chain stops at false",
+			src:  "n = 0; def f() begin n = n + 1, 2 end end 3 < 2 < f(); n",
+			want: Num(0),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := evalString(tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want.String() {
+				t.Errorf("Eval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 定義に失敗した演算子は残らない
+func TestInfix_Failed(t *testing.T) {
+	ip := NewInterpreter()
+	if _, err := ip.Parse("infix 6 left <+> (a, b) a +"); err == nil {
+		t.Fatal("want error")
+	}
+	if _, err := ip.Parse("1 <+> 2"); err == nil {
+		t.Error("<+> is defined")
+	}
+	if _, err := ip.Parse("1 <= 2"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInterpreter_DefineInfix(t *testing.T) {
+	ip := NewInterpreter()
+	if err := ip.DefineInfix("|>", 0, Left, func(x Value, f Value) Value {
+		return ip.call(toFunc(f), []Value{x})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ip.DefineInfix("+/-", 6, NonAssoc, func(x, y float64) *List {
+		return nil
+	}); err == nil {
+		t.Error("unsupported result type: want error")
+	}
+	if err := ip.DefineInfix("~=", 1, NonAssoc, func(x, y float64) bool {
+		return x-y < 1e-9 && y-x < 1e-9
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{"+", "**", ":", "a", ""} {
+		if err := ip.DefineInfix(bad, 6, Left, func(x, y float64) float64 { return x }); err == nil {
+			t.Errorf("DefineInfix(%q): want error", bad)
+		}
+	}
+	// 優先順位が範囲外なら関数も登録しない
+	if err := ip.DefineInfix("<+>", 10, Left, func(x, y float64) float64 { return x }); err == nil {
+		t.Errorf("DefineInfix(prec 10): want error")
+	}
+	if _, ok := ip.funcTable["<+>"]; ok {
+		t.Errorf("DefineInfix(prec 10) registered the function")
+	}
+	e, err := ip.Parse("[1, 4, 9] |> fn(xs) map(sqrt, xs) end |> sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ip.Eval(e); err != nil || got != Num(6) {
+		t.Errorf("Eval() = %v, %v, want 6", got, err)
+	}
+	// Compile と Clone にも引き継ぐ
+	p, err := ip.Compile("0.1 + 0.2 ~= 0.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := p.Run(nil); err != nil || got != Bool(true) {
+		t.Errorf("Run() = %v, %v, want true", got, err)
+	}
+	if _, err := ip.Clone().Parse("1 ~= 1"); err != nil {
+		t.Error(err)
+	}
+	if _, err := NewInterpreter().Parse("1 ~= 1"); err == nil {
+		t.Error("operator leaked to another interpreter")
+	}
+}
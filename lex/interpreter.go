@@ -0,0 +1,371 @@
+package lex
+
+import (
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/scanner"
+	"time"
+)
+
+// 計算機のインスタンス
+// 大域変数・関数表・字句解析器をインスタンスごとに持つので、
+// 複数のインタプリタを別々のゴルーチンから使ってもよい
+type Interpreter struct {
+	mu        sync.Mutex
+	lex       Lex
+	globalEnv map[Variable]Value
+	consts    map[Variable]Value // const で定義した定数
+	constRO   bool               // consts を Program と共有しているので書き換える前に複製する
+	funcTable map[string]Func
+	ops       *operators // 演算子表
+
+	// 出力先 (nil なら os.Stdout, os.Stderr)
+	Stdout, Stderr io.Writer
+	// true ならプロンプトと定義した関数名を表示しない
+	Quiet bool
+	// true なら文の値の真偽値を true, false と表示する
+	// false (既定) なら数値と同じく 1, 0 と表示する (比較が数値を返していたときと同じ)
+	BoolNames bool
+	// ユーザ定義関数の呼び出しの深さの上限 (0 なら DefaultMaxDepth)
+	MaxDepth int
+
+	// 資源の上限
+	Limits Limits
+	// 使える言語機能
+	Policy Policy
+	// 評価の方法
+	Backend Backend
+	// true なら構文木を最適化しない (定数の畳み込みなど。デバッグ用)
+	NoOptimize bool
+
+	vars  Resolver // 大域変数にない変数の値 (Program.Run で使う)
+	calls []string // 評価中の関数呼び出しの連鎖
+	steps int64    // 評価した節の数
+
+	deadline time.Time // Limits.Timeout による評価の期限
+
+	// 評価の中断
+	// ctx と done は評価するゴルーチンだけが触る。
+	// cancel は Interrupt から呼ばれるので cmu で守る
+	ctx    context.Context
+	done   <-chan struct{}
+	cmu    sync.Mutex
+	cancel context.CancelFunc
+}
+
+// 呼び出しの深さの上限の既定値
+const DefaultMaxDepth = 10000
+
+// 評価の方法
+// どちらで評価しても同じ値とエラーになる
+type Backend int
+
+const (
+	TreeWalk Backend = iota // 構文木をたどって評価する
+	Bytecode                // バイトコードにコンパイルしてスタックマシンで実行する
+)
+
+func (b Backend) String() string {
+	switch b {
+	case TreeWalk:
+		return "tree"
+	case Bytecode:
+		return "bytecode"
+	default:
+		return "Backend(" + strconv.Itoa(int(b)) + ")"
+	}
+}
+
+// 組み込み関数だけを持つインタプリタを作る
+func NewInterpreter() *Interpreter {
+	ip := &Interpreter{}
+	ip.reset()
+	ip.lex.ip = ip
+	return ip
+}
+
+// 入力を設定する
+func (ip *Interpreter) Init(src io.Reader) {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	ip.lex.Init(src)
+	ip.lex.Filename = "<stdin>"
+	ip.lex.ip = ip
+}
+
+// 大域変数・定数・ユーザ定義関数と演算子を消去する
+func (ip *Interpreter) Reset() {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	ip.reset()
+}
+
+func (ip *Interpreter) reset() {
+	ip.globalEnv = make(map[Variable]Value)
+	ip.consts = make(map[Variable]Value)
+	ip.funcTable = make(map[string]Func, len(builtinTable))
+	for name, f := range builtinTable {
+		ip.funcTable[name] = f
+	}
+	ip.ops = builtinOperators.clone()
+}
+
+// 大域変数とユーザ定義関数・演算子を複製した新しいインタプリタを作る
+// 字句解析器は複製しないので、Initで入力を設定すること
+func (ip *Interpreter) Clone() *Interpreter {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	c := &Interpreter{
+		globalEnv:  make(map[Variable]Value, len(ip.globalEnv)),
+		consts:     make(map[Variable]Value, len(ip.consts)),
+		funcTable:  make(map[string]Func, len(ip.funcTable)),
+		ops:        ip.ops.clone(),
+		Stdout:     ip.Stdout,
+		Stderr:     ip.Stderr,
+		Quiet:      ip.Quiet,
+		BoolNames:  ip.BoolNames,
+		MaxDepth:   ip.MaxDepth,
+		Limits:     ip.Limits,
+		Policy:     ip.Policy,
+		Backend:    ip.Backend,
+		NoOptimize: ip.NoOptimize,
+	}
+	c.lex.ip = c
+	for name, v := range ip.globalEnv {
+		c.globalEnv[name] = v
+	}
+	for name, v := range ip.consts {
+		c.consts[name] = v
+	}
+	for name, f := range ip.funcTable {
+		if u, ok := f.(*FuncU); ok {
+			g := *u
+			// 覚えておいた結果は共有しない
+			if u.memo != nil {
+				g.memo = newMemoTable()
+			}
+			f = &g
+		}
+		c.funcTable[name] = f
+	}
+	return c
+}
+
+func (ip *Interpreter) stdout() io.Writer {
+	if ip.Stdout == nil {
+		return os.Stdout
+	}
+	return ip.Stdout
+}
+
+func (ip *Interpreter) stderr() io.Writer {
+	if ip.Stderr == nil {
+		return os.Stderr
+	}
+	return ip.Stderr
+}
+
+// スクリプトの引数を設定する
+// 言語からは argc() と arg(i) (1 から数える) で参照する
+func (ip *Interpreter) SetArgs(args []string) {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	xs := make([]string, len(args))
+	copy(xs, args)
+	ip.funcTable["argc"] = Func0(func() float64 {
+		return float64(len(xs))
+	})
+	// 数値として読めるものは数値、それ以外は文字列になる
+	ip.funcTable["arg"] = FuncV{1, false, func(ip *Interpreter, args []Value) Value {
+		n := toIndex(args[0])
+		if n < 1 || n > len(xs) {
+			panic(runtimeError(Pos{}, "arg: index out of range: %v", n))
+		}
+		if x, err := strconv.ParseFloat(xs[n-1], 64); err == nil {
+			return Num(x)
+		}
+		return Str(xs[n-1])
+	}}
+}
+
+// ユーザ定義関数は呼び出し時に名前で引き直す
+// (複製したインタプリタで再定義した関数を呼ぶため)
+func (ip *Interpreter) userFunc(f *FuncU) *FuncU {
+	if g, ok := ip.funcTable[f.name].(*FuncU); ok {
+		return g
+	}
+	return f
+}
+
+// スクリプトを入力の終わりまで実行し、式の値を表示する
+// エラーがあればそこで止めて返す
+func (ip *Interpreter) Run(src io.Reader, name string) error {
+	return ip.RunContext(context.Background(), src, name)
+}
+
+// ctx が取り消されたら評価中の文を中断する Run
+func (ip *Interpreter) RunContext(ctx context.Context, src io.Reader, name string) error {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	var lex Lex
+	lex.Init(src)
+	lex.Filename = name
+	lex.ip = ip
+	for {
+		err := ip.topLevel1(ctx, &lex)
+		if err == ErrQuit {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// 文字列を構文解析する
+// 文は ';' で区切り、最後の ';' は省略できる
+// def は構文解析の時点で関数表に登録される
+func (ip *Interpreter) Parse(src string) (e Expr, err error) {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	defer catch(&err)
+	var lex Lex
+	lex.Init(strings.NewReader(src))
+	lex.Filename = "<input>"
+	lex.ip = ip
+	lex.getToken()
+	return parseProgram(&lex), nil
+}
+
+// 構文木を評価する
+func (ip *Interpreter) Eval(e Expr) (Value, error) {
+	return ip.EvalContext(context.Background(), e)
+}
+
+// 構文木を評価する
+// ctx が取り消されるか期限を過ぎたら評価を中断し、
+// ctx.Err() を包んだ *InterruptError を返す
+func (ip *Interpreter) EvalContext(ctx context.Context, e Expr) (v Value, err error) {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	defer catch(&err)
+	return ip.eval(ctx, e), nil
+}
+
+// トップレベルの式を評価する
+// 評価中は Interrupt で中断できる
+func (ip *Interpreter) eval(ctx context.Context, e Expr) Value {
+	ctx, cancel := context.WithCancel(ctx)
+	ip.setCancel(cancel)
+	defer ip.setCancel(nil)
+	return ip.evalIn(ctx, e)
+}
+
+// ctx の中で式を評価する
+// エラーで中断した評価の呼び出しの連鎖はここで捨てる
+func (ip *Interpreter) evalIn(ctx context.Context, e Expr) Value {
+	ip.deadline = time.Time{}
+	if ip.Limits.Timeout > 0 {
+		ip.deadline = time.Now().Add(ip.Limits.Timeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, ip.deadline)
+		defer cancel()
+	}
+	ip.ctx, ip.done = ctx, ctx.Done()
+	defer func() { ip.ctx, ip.done = nil, nil }()
+	ip.calls = ip.calls[:0]
+	ip.steps = 0
+	return ip.evalExpr(e, nil)
+}
+
+// Backend で選んだ方法で式を評価する
+func (ip *Interpreter) evalExpr(e Expr, env *Env) Value {
+	if _, ok := e.(*code); !ok && ip.Backend == Bytecode {
+		if c := compile(e); c != nil {
+			e = c
+		}
+	}
+	return e.Eval(ip, env)
+}
+
+func (ip *Interpreter) setCancel(cancel context.CancelFunc) {
+	ip.cmu.Lock()
+	defer ip.cmu.Unlock()
+	if ip.cancel != nil {
+		ip.cancel()
+	}
+	ip.cancel = cancel
+}
+
+// 評価中の式を中断する
+// 別のゴルーチン (シグナルハンドラなど) から呼んでよい
+// 評価中でなければ何もせず false を返す
+func (ip *Interpreter) Interrupt() bool {
+	ip.cmu.Lock()
+	defer ip.cmu.Unlock()
+	if ip.cancel == nil {
+		return false
+	}
+	ip.cancel()
+	return true
+}
+
+// 評価が中断されていれば pos の位置でエラーにする
+// ループの繰り返しと関数呼び出しのたびに調べる
+func (ip *Interpreter) checkInterrupt(pos Pos) {
+	select {
+	case <-ip.done:
+		err := ip.ctx.Err()
+		// Limits.Timeout の期限なら上限のエラーにする
+		if err == context.DeadlineExceeded && !ip.deadline.IsZero() && !time.Now().Before(ip.deadline) {
+			panic(&LimitError{pos, "timeout", ip.Limits.Timeout})
+		}
+		panic(&InterruptError{pos, err})
+	default:
+	}
+}
+
+func (ip *Interpreter) maxDepth() int {
+	if ip.MaxDepth <= 0 {
+		return DefaultMaxDepth
+	}
+	return ip.MaxDepth
+}
+
+// 入力の終わりまで文を読み込む
+func parseProgram(lex *Lex) Expr {
+	body := make([]Expr, 0)
+	for lex.Token != scanner.EOF {
+		lex.beginStatement()
+		switch lex.Token {
+		case DEF, MEMO:
+			defineFunc(lex)
+			lex.getToken()
+			continue
+		case DECLARE:
+			declareFunc(lex)
+			lex.getToken()
+			continue
+		case INFIX:
+			defineInfix(lex)
+			lex.getToken()
+			continue
+		}
+		body = append(body, statement(lex))
+		switch lex.Token {
+		case ';':
+			lex.getToken()
+		case scanner.EOF:
+		default:
+			panic(lex.syntaxError("invalid expression"))
+		}
+	}
+	if len(body) == 1 {
+		return body[0]
+	}
+	return newBgn(body)
+}
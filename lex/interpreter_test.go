@@ -0,0 +1,453 @@
+package lex
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 文字列を入力として quit まで実行する
+func run(ip *Interpreter, src string) {
+	ip.Init(strings.NewReader(src))
+	for !ip.TopLevel() {
+	}
+}
+
+func TestInterpreter_Clone(t *testing.T) {
+	ip := NewInterpreter()
+	run(ip, "a = 1; def f(x) x + a end quit")
+	c := ip.Clone()
+	run(c, "a = 10; def f(x) x * a end quit")
+	tests := []struct {
+		name string
+		ip   *Interpreter
+		want Value
+	}{
+		{
+			name: "original",
+			ip:   ip,
+			want: Num(3),
+		},
+		{
+			name: "clone",
+			ip:   c,
+			want: Num(20),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := tt.ip.funcTable["f"]
+			if got := newApp(f, []Expr{Num(2)}).Eval(tt.ip, nil); got != tt.want {
+				t.Errorf("Eval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInterpreter_Reset(t *testing.T) {
+	ip := NewInterpreter()
+	run(ip, "a = 1; def f(x) x end quit")
+	ip.Reset()
+	if _, ok := ip.globalEnv["a"]; ok {
+		t.Errorf("Reset() left global variable a")
+	}
+	if _, ok := ip.funcTable["f"]; ok {
+		t.Errorf("Reset() left user function f")
+	}
+	if _, ok := ip.funcTable["sqrt"]; !ok {
+		t.Errorf("Reset() removed builtin sqrt")
+	}
+}
+
+// 別々のインタプリタは並行に使える
+func TestInterpreter_Concurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			ip := NewInterpreter()
+			run(ip, "a = 0; while a < 100 do a = a + 1 end; quit")
+			if got := Variable("a").Eval(ip, nil); got != Num(100) {
+				t.Errorf("goroutine %d: a = %v, want 100", n, got)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestInterpreter_Parse(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    Value
+		wantErr interface{}
+	}{
+		{
+			name: "expression",
+			src:  "1 + 2 * 3",
+			want: Num(7),
+		},
+		{
+			name: "statements",
+			src:  "a = 2; b = a * 10; a + b;",
+			want: Num(22),
+		},
+		{
+			name: "def",
+			src:  "def sq(x) x * x end sq(5)",
+			want: Num(25),
+		},
+		{
+			name:    "syntax error",
+			src:     "(1 + 2",
+			wantErr: new(*SyntaxError),
+		},
+		{
+			name:    "arity error",
+			src:     "sqrt(1, 2)",
+			wantErr: new(*ArityError),
+		},
+		{
+			name:    "unbound variable",
+			src:     "undefined + 1",
+			wantErr: new(*UnboundVariableError),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := NewInterpreter()
+			e, err := ip.Parse(tt.src)
+			if err == nil {
+				var got Value
+				got, err = ip.Eval(e)
+				if err == nil && got != tt.want {
+					t.Errorf("Eval() = %v, want %v", got, tt.want)
+				}
+			}
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+			} else if !errors.As(err, tt.wantErr) {
+				t.Errorf("error = %T %v, want %T", err, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Go の実行時エラーは計算のエラーと区別し、panic した位置のスタックを残す
+func TestInterpreter_InternalError(t *testing.T) {
+	ip := NewInterpreter()
+	if err := ip.Register("broken", func(i float64) float64 {
+		return []float64{1}[int(i)]
+	}); err != nil {
+		t.Fatal(err)
+	}
+	e, err := ip.Parse("broken(3)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ip.Eval(e)
+	var ie *InternalError
+	if !errors.As(err, &ie) {
+		t.Fatalf("error = %T %v, want *InternalError", err, err)
+	}
+	if !strings.Contains(string(ie.Stack), "TestInterpreter_InternalError") {
+		t.Errorf("Stack does not show where it panicked:\n%s", ie.Stack)
+	}
+}
+
+func TestInterpreter_ParseQuit(t *testing.T) {
+	if _, err := NewInterpreter().Parse("quit"); err != ErrQuit {
+		t.Errorf("Parse() error = %v, want ErrQuit", err)
+	}
+}
+
+func TestInterpreter_Run(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "script",
+			src:  "#!/usr/bin/env calc run\na = 2; # コメント\na * 3;\n",
+			want: "2\n6\n",
+		},
+		{
+			name: "args",
+			src:  "argc(); arg(1) + arg(2);",
+			args: []string{"1.5", "2"},
+			want: "2\n3.5\n",
+		},
+		{
+			name:    "stop at error",
+			src:     "1; x; 2;",
+			want:    "1\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			ip := NewInterpreter()
+			ip.Stdout = &out
+			ip.SetArgs(tt.args)
+			err := ip.Run(strings.NewReader(tt.src), "test.calc")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("Run() output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// 数値だけを使うプログラムは、真偽値の型を加える前と同じ出力になる
+// (比較や not の値は 1, 0 と表示する)
+func TestInterpreter_BaselineOutput(t *testing.T) {
+	src := `1 < 2;
+2 <= 1;
+1 == 1;
+3 != 3;
+not 0;
+not 5;
+1 and 0;
+2 or 0;
+(1 < 2) + 1;
+a = 5 > 3;
+def f(n) if n < 2 then n else f(n - 1) + f(n - 2) end end
+f(10);
+def even(n) if n == 0 then 1 < 2 else not even(n - 1) end end
+even(4);
+let x = 2 in x * 3 > 5 end;
+if 0 then 1 else 2 > 1 end;
+`
+	// 真偽値の型を加える前のインタプリタの出力
+	want := "Calc> 1\nCalc> 0\nCalc> 1\nCalc> 0\nCalc> 1\nCalc> 0\nCalc> 0\nCalc> 2\n" +
+		"Calc> 2\nCalc> 1\nCalc> f\nCalc> 55\nCalc> even\nCalc> 1\nCalc> 1\nCalc> 1\nCalc> "
+	for _, b := range []Backend{TreeWalk, Bytecode} {
+		var out strings.Builder
+		ip := NewInterpreter()
+		ip.Stdout = &out
+		ip.Backend = b
+		ip.Init(strings.NewReader(src))
+		for !ip.TopLevel() {
+		}
+		if got := out.String(); got != want {
+			t.Errorf("%v: output = %q, want %q", b, got, want)
+		}
+	}
+	ip := NewInterpreter()
+	var out strings.Builder
+	ip.Stdout = &out
+	ip.BoolNames = true
+	if err := ip.Run(strings.NewReader("1 < 2; not 1; 1 + 1;"), "test.calc"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "true\nfalse\n2\n"; got != want {
+		t.Errorf("BoolNames: output = %q, want %q", got, want)
+	}
+}
+
+func TestInterpreter_MaxDepth(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxDepth int
+		src      string
+		want     Value
+		chain    string
+	}{
+		{
+			name:  "infinite recursion",
+			src:   "def f(n) f(n + 1) + 1 end f(0)",
+			chain: "f -> f -> f -> ... -> f",
+		},
+		{
+			name:     "mutual recursion",
+			maxDepth: 10,
+			src: "def even(n) if n == 0 then true else odd(n - 1) == true end end " +
+				"def odd(n) if n == 0 then false else even(n - 1) == true end end even(100)",
+			chain: "even -> odd -> even -> ... -> even -> odd -> even -> odd -> even",
+		},
+		{
+			name:     "closure",
+			maxDepth: 3,
+			src:      "g = fn(n) g(n + 1) + 1 end; map(g, [1])",
+			chain:    "fn -> fn -> fn -> fn",
+		},
+		{
+			name:     "tail calls do not count",
+			maxDepth: 10,
+			src:      "def f(n) if n == 0 then 0 else f(n - 1) end end f(100)",
+			want:     Num(0),
+		},
+		{
+			name:     "within limit",
+			maxDepth: 10,
+			src:      "def f(n) if n == 0 then 0 else f(n - 1) end end f(9)",
+			want:     Num(0),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := NewInterpreter()
+			ip.MaxDepth = tt.maxDepth
+			e, err := ip.Parse(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ip.Eval(e)
+			if tt.chain == "" {
+				if err != nil || got != tt.want {
+					t.Errorf("Eval() = %v, %v, want %v", got, err, tt.want)
+				}
+				return
+			}
+			var re *RecursionError
+			if !errors.As(err, &re) {
+				t.Fatalf("Eval() error = %v, want RecursionError", err)
+			}
+			if !re.Pos.IsValid() {
+				t.Errorf("RecursionError has no position")
+			}
+			if !strings.Contains(err.Error(), tt.chain) {
+				t.Errorf("Error() = %q, want chain %q", err.Error(), tt.chain)
+			}
+		})
+	}
+}
+
+// 深い再帰のエラーのあとも状態を保ったまま評価を続けられる
+func TestInterpreter_MaxDepthRecover(t *testing.T) {
+	var out, errOut strings.Builder
+	ip := NewInterpreter()
+	ip.Stdout, ip.Stderr, ip.Quiet = &out, &errOut, true
+	// エラーのあとは行の残りを読み飛ばすので文を行に分ける
+	run(ip, "a = 1; def f(n) f(n + 1) + 1 end\nf(0);\na + 1; quit")
+	if !strings.Contains(errOut.String(), "maximum recursion depth exceeded") {
+		t.Errorf("stderr = %q", errOut.String())
+	}
+	if got, want := out.String(), "1\n2\n"; got != want {
+		t.Errorf("stdout = %q, want %q", got, want)
+	}
+	if len(ip.calls) != 0 {
+		t.Errorf("calls = %v, want empty", ip.calls)
+	}
+}
+
+func TestInterpreter_EvalContext(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want error
+	}{
+		{
+			name: "while",
+			src:  "while 1 do 0 end",
+			want: context.DeadlineExceeded,
+		},
+		{
+			name: "for",
+			src:  "for i in range(1000) do while 1 do 0 end end",
+			want: context.DeadlineExceeded,
+		},
+		{
+			name: "recursion",
+			src:  "def f(n) if n == 0 then 0 else f(n - 1) + f(n - 1) end end f(100)",
+			want: context.DeadlineExceeded,
+		},
+		{
+			name: "builtin",
+			src:  "len(range(3e7))",
+			want: context.DeadlineExceeded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := NewInterpreter()
+			e, err := ip.Parse(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err = ip.EvalContext(ctx, e)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("EvalContext() error = %v, want %v", err, tt.want)
+			}
+			var ie *InterruptError
+			if !errors.As(err, &ie) || !ie.Pos.IsValid() {
+				t.Errorf("EvalContext() error = %#v, want InterruptError with position", err)
+			}
+		})
+	}
+}
+
+func TestInterpreter_EvalContextCanceled(t *testing.T) {
+	ip := NewInterpreter()
+	e, err := ip.Parse("while 1 do 0 end")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ip.EvalContext(ctx, e); !errors.Is(err, context.Canceled) {
+		t.Errorf("EvalContext() error = %v, want context.Canceled", err)
+	}
+	// 取り消しは次の評価に持ち越さない
+	if v, err := ip.Eval(Num(1)); err != nil || v != Num(1) {
+		t.Errorf("Eval() = %v, %v, want 1", v, err)
+	}
+}
+
+// 評価中の式だけを中断し、大域変数は残る
+func TestInterpreter_Interrupt(t *testing.T) {
+	ip := NewInterpreter()
+	if ip.Interrupt() {
+		t.Errorf("Interrupt() = true while idle")
+	}
+	var out, errOut strings.Builder
+	ip.Stdout, ip.Stderr, ip.Quiet = &out, &errOut, true
+	ip.Init(strings.NewReader("a = 1; while 1 do a = a + 1 end;\na > 1;\n"))
+	done := make(chan bool)
+	go func() {
+		for !ip.TopLevel() {
+		}
+		done <- true
+	}()
+	// a = 1 の評価中に呼ぶと while まで届かないので終わるまで繰り返す
+wait:
+	for {
+		select {
+		case <-done:
+			break wait
+		default:
+			ip.Interrupt()
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if !strings.Contains(errOut.String(), "interrupted") {
+		t.Errorf("stderr = %q", errOut.String())
+	}
+	if got, want := out.String(), "1\n1\n"; got != want {
+		t.Errorf("stdout = %q, want %q", got, want)
+	}
+}
+
+// 新しいインタプリタで文字列を構文解析して評価する
+func evalString(src string) (Value, error) {
+	ip := NewInterpreter()
+	e, err := ip.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return ip.Eval(e)
+}
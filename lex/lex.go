@@ -1,9 +1,10 @@
 package lex
 
 import (
+	"context"
 	"fmt"
-	"log"
-	"os"
+	"io"
+	"strconv"
 	"text/scanner"
 )
 
@@ -14,7 +15,81 @@ func init() {
 // Lexとは、レキシカルアナライザ(字句解析プログラム)ジェネレータのこと
 type Lex struct {
 	scanner.Scanner
-	Token rune
+	Token   rune
+	ip      *Interpreter // 関数表の参照先
+	src     *source      // 読み込んだソース
+	end     Pos          // 直前のトークンの終了位置
+	scanErr string       // スキャナが報告したエラー
+	nodes   int          // 読み込み中の文の構文木の節の数
+	depth   int          // 読み込み中の式の入れ子の深さ
+	locals  [][]Variable // 読み込み中の位置で見える局所変数 (環境ごと、内側が後ろ)
+	opText  string       // 2文字以上の演算子の綴り
+}
+
+// 入力を設定する
+func (lex *Lex) Init(src io.Reader) {
+	lex.src = &source{r: src}
+	lex.Scanner.Init(lex.src)
+	// コメントは '#' だけ ("//" は整数除算の演算子)
+	lex.Mode &^= scanner.ScanComments | scanner.SkipComments
+	lex.Error = func(s *scanner.Scanner, msg string) {
+		lex.scanErr = msg
+	}
+}
+
+// 現在のトークンの位置
+func (lex *Lex) tokenPos() Pos {
+	return Pos{lex.Position, lex.src}
+}
+
+// 文の読み込みを始める
+// エラーで中断した文の状態はここで捨てる
+func (lex *Lex) beginStatement() {
+	lex.nodes = 0
+	lex.depth = 0
+	lex.locals = lex.locals[:0]
+}
+
+// 局所変数 xs の環境を有効範囲に加える
+// 評価するときも同じ順に環境を作る。戻り値を popLocals に渡すと元に戻す
+func (lex *Lex) pushLocals(xs ...Variable) int {
+	n := len(lex.locals)
+	lex.locals = append(lex.locals, append([]Variable(nil), xs...))
+	return n
+}
+
+func (lex *Lex) popLocals(n int) {
+	lex.locals = lex.locals[:n]
+}
+
+// 一番内側の環境に局所変数を加える
+func (lex *Lex) addLocal(x Variable) {
+	i := len(lex.locals) - 1
+	lex.locals[i] = append(lex.locals[i], x)
+}
+
+// 変数の位置を決める
+// 内側の環境から探し、同じ環境では後で加えたものを優先する
+func (lex *Lex) resolve(name Variable) addr {
+	for depth := 0; depth < len(lex.locals); depth++ {
+		xs := lex.locals[len(lex.locals)-1-depth]
+		for slot := len(xs) - 1; slot >= 0; slot-- {
+			if xs[slot] == name {
+				return addr{true, depth, slot}
+			}
+		}
+	}
+	return addr{}
+}
+
+// 構文木に start から直前のトークンまでの範囲を記録する
+// 節の数もここで数える
+func (lex *Lex) mark(e Expr, start Pos) Expr {
+	lex.countNode(start)
+	if n, ok := e.(interface{ setSpan(start, end Pos) }); ok {
+		n.setSpan(start, lex.end)
+	}
+	return e
 }
 
 // キーワード
@@ -38,6 +113,20 @@ const (
 	DO
 	LET
 	IN
+	FOR
+	FN
+	DECLARE
+	CONST
+	XOR
+	IDIV   // //
+	SHL    // <<
+	SHR    // >>
+	ADDAGN // +=
+	SUBAGN // -=
+	MULAGN // *=
+	DIVAGN // /=
+	INFIX
+	MEMO
 )
 
 var keyTable = make(map[string]rune)
@@ -56,32 +145,71 @@ func initKeyTable() {
 	keyTable["do"] = DO
 	keyTable["let"] = LET
 	keyTable["in"] = IN
+	keyTable["for"] = FOR
+	keyTable["fn"] = FN
+	keyTable["declare"] = DECLARE
+	keyTable["const"] = CONST
+	keyTable["xor"] = XOR
+	keyTable["infix"] = INFIX
+	keyTable["memo"] = MEMO
+}
+
+// 演算子の表示名 (エラーメッセージ用)
+func opName(code rune) string {
+	switch code {
+	case EQ:
+		return "=="
+	case NE:
+		return "!="
+	case LT:
+		return "<"
+	case GT:
+		return ">"
+	case LE:
+		return "<="
+	case GE:
+		return ">="
+	case NOT:
+		return "not "
+	case XOR:
+		return " xor "
+	case IDIV:
+		return "//"
+	case SHL:
+		return "<<"
+	case SHR:
+		return ">>"
+	default:
+		return string(code)
+	}
 }
 
 // 短絡演算子
 type Ops struct {
+	span
 	code        rune
 	left, right Expr
 }
 
 func newOps(code rune, left, right Expr) Expr {
-	return &Ops{code, left, right}
+	return &Ops{code: code, left: left, right: right}
 }
 
 // 短絡演算子の評価
-func (e *Ops) Eval(env *Env) Value {
-	x := e.left.Eval(env)
+func (e *Ops) Eval(ip *Interpreter, env *Env) Value {
+	ip.tick(e.start)
+	x := e.left.Eval(ip, env)
 	switch e.code {
 	case AND:
 		if isTrue(x) {
-			return e.right.Eval(env)
+			return e.right.Eval(ip, env)
 		}
 		return x
 	case OR:
 		if isTrue(x) {
 			return x
 		}
-		return e.right.Eval(env)
+		return e.right.Eval(ip, env)
 	default:
 		panic(fmt.Errorf("invalid Ops code"))
 	}
@@ -89,19 +217,21 @@ func (e *Ops) Eval(env *Env) Value {
 
 // if
 type Sel struct {
+	span
 	testForm, thenForm, elseForm Expr
 }
 
 func newSel(testForm, thenForm, elseForm Expr) *Sel {
-	return &Sel{testForm, thenForm, elseForm}
+	return &Sel{testForm: testForm, thenForm: thenForm, elseForm: elseForm}
 }
 
 // if式の評価
-func (e *Sel) Eval(env *Env) Value {
-	if isTrue(e.testForm.Eval(env)) {
-		return e.thenForm.Eval(env)
+func (e *Sel) Eval(ip *Interpreter, env *Env) Value {
+	ip.tick(e.start)
+	if isTrue(e.testForm.Eval(ip, env)) {
+		return e.thenForm.Eval(ip, env)
 	}
-	return e.elseForm.Eval(env)
+	return e.elseForm.Eval(ip, env)
 }
 
 // ifの処理
@@ -115,57 +245,46 @@ func makeSel(lex *Lex) Expr {
 			lex.getToken()
 			elseForm := expression(lex)
 			if lex.Token != END {
-				panic(fmt.Errorf("'end' expected"))
+				panic(lex.syntaxError("'end' expected"))
 			}
 			lex.getToken()
 			return newSel(testForm, thenForm, elseForm)
 		case END:
 			lex.getToken()
-			return newSel(testForm, thenForm, Value(0.0))
+			return newSel(testForm, thenForm, Num(0))
 		default:
-			panic(fmt.Errorf("'else' or 'end' expected"))
+			panic(lex.syntaxError("'else' or 'end' expected"))
 		}
 	} else {
-		panic(fmt.Errorf("'then' expected"))
+		panic(lex.syntaxError("'then' expected"))
 	}
-	// このブロックには到達しない
-	return nil
 }
 
 // 標準入力を1つ読み込んでruneを持つ
 func (lex *Lex) getToken() {
+	lex.end = Pos{lex.Pos(), lex.src}
+	lex.opText = ""
+	n := lex.ErrorCount
 	lex.Token = lex.Scan()
+	// '#' から行末まではコメント (#! で始まるスクリプトも読める)
+	for lex.Token == '#' {
+		for c := lex.Peek(); c != '\n' && c != scanner.EOF; c = lex.Peek() {
+			lex.Next()
+		}
+		lex.Token = lex.Scan()
+	}
+	if lex.ErrorCount > n {
+		panic(lex.syntaxError("%v", lex.scanErr))
+	}
 	switch lex.Token {
 	case scanner.Ident:
 		key, ok := keyTable[lex.TokenText()]
 		if ok {
 			lex.Token = key
 		}
-	case '=':
-		if lex.Peek() == '=' {
-			lex.Next()
-			lex.Token = EQ
-		}
-	case '!':
-		if lex.Peek() == '=' {
-			lex.Next()
-			lex.Token = NE
-		} else {
-			lex.Token = NOT
-		}
-	case '<':
-		if lex.Peek() == '=' {
-			lex.Next()
-			lex.Token = LE
-		} else {
-			lex.Token = LT
-		}
-	case '>':
-		if lex.Peek() == '=' {
-			lex.Next()
-			lex.Token = GE
-		} else {
-			lex.Token = GT
+	default:
+		if isOpChar(lex.Token) {
+			lex.scanOperator()
 		}
 	}
 }
@@ -174,7 +293,7 @@ func (lex *Lex) getToken() {
 func getArgs(lex *Lex) []Expr {
 	e := make([]Expr, 0)
 	if lex.Token != '(' {
-		panic(fmt.Errorf("'(' expected"))
+		panic(lex.syntaxError("'(' expected"))
 	}
 	lex.getToken()
 	if lex.Token == ')' {
@@ -190,183 +309,318 @@ func getArgs(lex *Lex) []Expr {
 		case ',':
 			lex.getToken()
 		default:
-			panic(fmt.Errorf("unexpected token in argument list"))
+			panic(lex.syntaxError("unexpected token in argument list"))
 		}
 	}
 }
 
 // factor: 因子
-// 因子 = 数値 | ("+" | "-"), 因子 | "(" 式 ")".
+// 因子 = 基本式 { "[" 添字 "]" | "." 名前 | "(" 引数 ")" }.
 func factor(lex *Lex) Expr {
+	start := lex.tokenPos()
+	e := primary(lex)
+	for {
+		switch lex.Token {
+		case '[':
+			lex.getToken()
+			e = lex.mark(makeIndex(lex, e), start)
+		case '.':
+			// m.a は m["a"] と同じ
+			lex.getToken()
+			if lex.Token != scanner.Ident {
+				panic(lex.syntaxError("field name expected"))
+			}
+			key := Str(lex.TokenText())
+			lex.getToken()
+			e = lex.mark(newIndex(e, key), start)
+		case '(':
+			// 変数に入れた関数値などの呼び出し
+			e = lex.mark(newCall(e, getArgs(lex)), start)
+		default:
+			return e
+		}
+	}
+}
+
+// 基本式 = 数値 | 文字列 | リスト | ("+" | "-"), 因子 | "(" 式 ")" | ...
+func primary(lex *Lex) Expr {
+	start := lex.tokenPos()
+	lex.enterNesting(start)
+	defer lex.leaveNesting()
 	switch lex.Token {
 	case '(':
 		lex.getToken()
 		e := expression(lex)
 		if lex.Token != ')' {
-			panic(fmt.Errorf("')' expected"))
+			panic(lex.syntaxError("')' expected"))
 		}
 		lex.getToken()
 		return e
 	case '+':
 		lex.getToken()
-		return newOp1('+', factor(lex))
+		return lex.mark(newOp1('+', power(lex)), start)
 	case '-':
 		lex.getToken()
-		return newOp1('-', factor(lex))
+		return lex.mark(newOp1('-', power(lex)), start)
+	case '~':
+		lex.getToken()
+		return lex.mark(newOp1('~', power(lex)), start)
 	case scanner.Int, scanner.Float:
 		var n float64
 		fmt.Sscan(lex.TokenText(), &n)
 		lex.getToken()
-		return Value(n)
+		return lex.mark(Num(n), start)
+	case scanner.String, scanner.RawString:
+		str, err := strconv.Unquote(lex.TokenText())
+		if err != nil {
+			panic(lex.syntaxError("invalid string literal: %v", lex.TokenText()))
+		}
+		lex.getToken()
+		return lex.mark(Str(str), start)
 	case scanner.Ident:
 		name := lex.TokenText()
 		lex.getToken()
-		if name == "quit" {
-			panic(name)
+		switch name {
+		case "quit":
+			panic(ErrQuit)
+		case "true":
+			return lex.mark(Bool(true), start)
+		case "false":
+			return lex.mark(Bool(false), start)
+		case "nil":
+			return lex.mark(Nil{}, start)
 		}
-		v, ok := funcTable[name]
+		v, ok := lex.ip.funcTable[name]
 		if ok {
+			checkPolicy(start, !lex.ip.Policy.allowFunc(name), "function "+name)
+			if lex.Token != '(' {
+				// 関数名だけなら関数値
+				return lex.mark(newFuncVal(name, v), start)
+			}
 			xs := getArgs(lex)
-			if len(xs) != v.Argc() {
-				panic(fmt.Errorf("wrong number of argumnts: %v", name))
+			if !arityOK(v, len(xs)) {
+				panic(arityError(start, name, v, len(xs)))
 			}
-			return newApp(v, xs)
+			return lex.mark(newApp(v, xs), start)
 		} else {
-			return Variable(name)
+			v := newVarRef(Variable(name))
+			v.addr = lex.resolve(v.name)
+			return lex.mark(v, start)
 		}
+	case '[':
+		lex.getToken()
+		return lex.mark(makeList(lex), start)
+	case '{':
+		lex.getToken()
+		return lex.mark(makeMap(lex), start)
 	case NOT:
 		lex.getToken()
-		return newOp1(NOT, factor(lex))
+		return lex.mark(newOp1(NOT, power(lex)), start)
 	case IF:
 		lex.getToken()
-		return makeSel(lex)
+		return lex.mark(makeSel(lex), start)
 	case BGN:
 		lex.getToken()
-		return makeBegin(lex)
+		return lex.mark(makeBegin(lex), start)
 	case WHL:
+		checkPolicy(start, lex.ip.Policy.NoWhile, "while")
 		lex.getToken()
-		return makeWhile(lex)
+		return lex.mark(makeWhile(lex), start)
 	case LET:
 		lex.getToken()
-		return makeLet(lex)
+		return lex.mark(makeLet(lex), start)
+	case FOR:
+		lex.getToken()
+		return lex.mark(makeFor(lex), start)
+	case FN:
+		lex.getToken()
+		return lex.mark(makeLambda(lex), start)
 	default:
-		panic(fmt.Errorf("unexpected token: %v", lex.TokenText()))
+		panic(lex.syntaxError("unexpected token: %v", lex.tokenText()))
 	}
 }
 
+// 累乗以上の二項演算子の式
+// 単項演算子の被演算子 (-2^2 は -(2^2)、2^-1 は 2^(-1))
+func power(lex *Lex) Expr {
+	return binaryExpr(lex, precPower)
+}
+
 // term: 項
-// 項  = 因子 { ("*" | "/"), 因子 }.
+// 項 = 乗除 ("*" | "/" | "//" | "%") 以上の二項演算子の式
 func term(lex *Lex) Expr {
-	e := factor(lex)
-	for {
-		switch lex.Token {
-		case '*':
-			lex.getToken()
-			e = newOp2('*', e, factor(lex))
-		case '/':
-			lex.getToken()
-			e = newOp2('/', e, factor(lex))
-		default:
-			return e
-		}
-	}
+	return binaryExpr(lex, precMul)
 }
 
-// 論理演算子
+// 論理演算子 (すべての二項演算子の式)
 func expr1(lex *Lex) Expr {
-	e := expr2(lex)
-	for {
-		x := lex.Token
-		switch x {
-		case AND, OR:
-			lex.getToken()
-			e = newOps(x, e, expr2(lex))
-		default:
-			return e
-		}
-	}
+	return binaryExpr(lex, precLogic)
 }
 
-// 比較演算子
+// 比較演算子以上の二項演算子の式
 func expr2(lex *Lex) Expr {
-	e := expr3(lex)
-	x := lex.Token
-	switch x {
-	case EQ, NE, LT, GT, LE, GE:
-		lex.getToken()
-		return newOp2(x, e, expr3(lex))
-	default:
-		return e
-	}
+	return binaryExpr(lex, precCompare)
 }
 
-// 式
+// 加減以上の二項演算子の式
 func expr3(lex *Lex) Expr {
-	e := term(lex)
+	return binaryExpr(lex, precAdd)
+}
+
+// 二項演算子の式 (演算子順位法)
+// 優先順位が prec 以上の演算子だけを読み、優先順位と結合性は演算子表 (infix.go) で決める
+// 式 = 因子 { 二項演算子, 式 }.
+func binaryExpr(lex *Lex, prec int) Expr {
+	start := lex.tokenPos()
+	e := factor(lex)
 	for {
-		switch lex.Token {
-		case '+':
-			lex.getToken()
-			e = newOp2('+', e, term(lex))
-		case '-':
-			lex.getToken()
-			e = newOp2('-', e, term(lex))
-		default:
+		op, ok := lex.operators().infix[lex.Token]
+		if !ok || op.Prec < prec {
 			return e
 		}
+		lex.getToken()
+		switch op.Assoc {
+		case Left:
+			e = lex.mark(op.node(lex, e, binaryExpr(lex, op.Prec+1)), start)
+		case Right:
+			e = lex.mark(op.node(lex, e, binaryExpr(lex, op.Prec)), start)
+		case NonAssoc:
+			e = lex.mark(op.node(lex, e, binaryExpr(lex, op.Prec+1)), start)
+			if next, ok := lex.operators().infix[lex.Token]; ok && next.Prec == op.Prec {
+				panic(lex.syntaxError("operator %v is not associative", op.name))
+			}
+		case chain:
+			// a < b < c は a < b and b < c
+			codes := []rune{op.code}
+			xs := []Expr{e, binaryExpr(lex, op.Prec+1)}
+			for {
+				next, ok := lex.operators().infix[lex.Token]
+				if !ok || next.Prec != op.Prec || next.Assoc != chain {
+					break
+				}
+				lex.getToken()
+				codes = append(codes, next.code)
+				xs = append(xs, binaryExpr(lex, op.Prec+1))
+			}
+			if len(codes) == 1 {
+				e = lex.mark(newOp2(op.code, xs[0], xs[1]), start)
+			} else {
+				e = lex.mark(newChain(codes, xs), start)
+			}
+		}
 	}
 }
 
 // expression: 式
-// 式  = 項 { ("+" | "-"), 項 }.
+// 式 = 二項演算子の式 [ 代入演算子, 式 ].
 func expression(lex *Lex) Expr {
+	start := lex.tokenPos()
 	e := expr1(lex)
-	if lex.Token == '=' {
-		v, ok := e.(Variable)
-		if ok {
-			lex.getToken()
-			return newAgn(v, expression(lex))
-		} else {
-			panic(fmt.Errorf("invalid assign form"))
+	code, ok := assignOps[lex.Token]
+	if !ok {
+		return e
+	}
+	switch v := e.(type) {
+	case *VarRef:
+		checkPolicy(start, lex.ip.Policy.NoGlobalAssign && !v.local,
+			"assignment to global variable "+string(v.name))
+		lex.getToken()
+		if code == 0 {
+			a := newAgn(v.name, expression(lex))
+			a.addr = v.addr
+			return lex.mark(a, start)
 		}
+		a := newOpAgn(v.name, code, expression(lex))
+		a.addr = v.addr
+		return lex.mark(a, start)
+	case *Index:
+		lex.getToken()
+		a := newIndexAgn(v, expression(lex))
+		a.code = code
+		return lex.mark(a, start)
+	default:
+		panic(lex.syntaxError("invalid assign form"))
 	}
-	return e
+}
+
+// 代入演算子と演算 (= は 0)
+var assignOps = map[rune]rune{
+	'=':    0,
+	ADDAGN: '+',
+	SUBAGN: '-',
+	MULAGN: '*',
+	DIVAGN: '/',
+}
+
+// 文 = 式 | "const" 名前 "=" 式
+// def と declare は呼び出し側で扱う
+func statement(lex *Lex) Expr {
+	if lex.Token == CONST {
+		return lex.ip.optimize(makeConst(lex))
+	}
+	return lex.ip.optimize(expression(lex))
 }
 
 // TopLevel
 // 入力 - 評価 - 表示
-func TopLevel(lex *Lex) (r bool) {
-	r = false
-	defer func() {
-		err := recover()
+// quit または入力の終わりで true を返す
+func (ip *Interpreter) TopLevel() (r bool) {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	lex := &ip.lex
+	for {
+		if !ip.Quiet {
+			fmt.Fprint(ip.stdout(), "Calc> ")
+		}
+		err := ip.topLevel1(context.Background(), lex)
+		if err == ErrQuit {
+			return true
+		}
 		if err != nil {
-			mes, ok := err.(string)
-			if ok && mes == "quit" {
-				r = true
-			} else {
-				fmt.Fprintln(os.Stderr, err)
-				for {
-					c:= lex.Peek()
-					if c == '\n' {break }
-					lex.Next()
+			fmt.Fprintln(ip.stderr(), FormatError(err))
+			// 行の残りを読み飛ばす
+			for {
+				c := lex.Peek()
+				if c == '\n' || c == scanner.EOF {
+					break
 				}
+				lex.Next()
 			}
+			return false
 		}
-	}()
-	for {
-		fmt.Print("Calc> ")
-		lex.getToken()
-		if lex.Token == DEF {
-			defineFunc(lex)
-		} else {
-			e := expression(lex)
-			if lex.Token != ';' {
-				log.Println(lex.TokenText())
-				panic(fmt.Errorf("invalid expression"))
-			} else {
-				fmt.Println(e.Eval(nil))
-			}
+	}
+}
+
+// 1つの文を読み込んで評価し、結果を表示する
+func (ip *Interpreter) topLevel1(ctx context.Context, lex *Lex) (err error) {
+	defer catch(&err)
+	lex.beginStatement()
+	lex.src.forget(lex.Pos().Offset)
+	lex.getToken()
+	switch lex.Token {
+	case scanner.EOF:
+		return ErrQuit
+	case DEF, MEMO:
+		name := defineFunc(lex)
+		if !ip.Quiet {
+			fmt.Fprintln(ip.stdout(), name)
+		}
+	case DECLARE:
+		name := declareFunc(lex)
+		if !ip.Quiet {
+			fmt.Fprintln(ip.stdout(), name)
 		}
+	case INFIX:
+		name := defineInfix(lex)
+		if !ip.Quiet {
+			fmt.Fprintln(ip.stdout(), name)
+		}
+	default:
+		e := statement(lex)
+		if lex.Token != ';' {
+			panic(lex.syntaxError("invalid expression"))
+		}
+		fmt.Fprintln(ip.stdout(), ip.show(ip.eval(ctx, e)))
 	}
-	return r
+	return nil
 }
@@ -19,22 +19,22 @@ func TestLex_getToken(t *testing.T) {
 		{
 			name: "num + num",
 			expr: "1 + 3 ;",
-			want: []interface{}{Value(1), '+', Value(3), ';'},
+			want: []interface{}{Num(1), '+', Num(3), ';'},
 		},
 		{
 			name: "num - num",
 			expr: "1 - 3 ;",
-			want: []interface{}{Value(1), '-', Value(3), ';'},
+			want: []interface{}{Num(1), '-', Num(3), ';'},
 		},
 		{
 			name: "num * num",
 			expr: "1 * 3 ;",
-			want: []interface{}{Value(1), '*', Value(3), ';'},
+			want: []interface{}{Num(1), '*', Num(3), ';'},
 		},
 		{
 			name: "num / num",
 			expr: "1 / 3 ;",
-			want: []interface{}{Value(1), '/', Value(3), ';'},
+			want: []interface{}{Num(1), '/', Num(3), ';'},
 		},
 	}
 	for _, tt := range tests {
@@ -58,7 +58,7 @@ func TestLex_getToken(t *testing.T) {
 				case Value:
 					var n float64
 					fmt.Sscan(l.TokenText(), &n)
-					v := Value(n)
+					v := Num(n)
 					if tt.want[i] != v {
 						t.Errorf("failed, want %v, get %v", tt.want[i], v)
 					}
@@ -95,109 +95,109 @@ func TestOps_Eval(t *testing.T) {
 			name: "truthy and truthy",
 			fields: fields{
 				code:  AND,
-				left:  Value(1.0),
-				right: Value(1.0),
+				left:  Num(1.0),
+				right: Num(1.0),
 			},
 			args: args{
 				env: &Env{},
 			},
-			want: Value(1.0),
+			want: Num(1.0),
 		},
 		{
 			name: "truthy and falsy",
 			fields: fields{
 				code:  AND,
-				left:  Value(1.0),
-				right: Value(0.0),
+				left:  Num(1.0),
+				right: Num(0.0),
 			},
 			args: args{
 				env: &Env{},
 			},
-			want: Value(0.0),
+			want: Num(0.0),
 		},
 		{
 			name: "falsy and truthy",
 			fields: fields{
 				code:  AND,
-				left:  Value(0.0),
-				right: Value(1.0),
+				left:  Num(0.0),
+				right: Num(1.0),
 			},
 			args: args{
 				env: &Env{},
 			},
-			want: Value(0.0),
+			want: Num(0.0),
 		},
 		{
 			name: "falsy and falsy",
 			fields: fields{
 				code:  AND,
-				left:  Value(0.0),
-				right: Value(0.0),
+				left:  Num(0.0),
+				right: Num(0.0),
 			},
 			args: args{
 				env: &Env{},
 			},
-			want: Value(0.0),
+			want: Num(0.0),
 		},
 		{
 			name: "truthy or truthy",
 			fields: fields{
 				code:  OR,
-				left:  Value(1.0),
-				right: Value(1.0),
+				left:  Num(1.0),
+				right: Num(1.0),
 			},
 			args: args{
 				env: &Env{},
 			},
-			want: Value(1.0),
+			want: Num(1.0),
 		},
 		{
 			name: "truthy or falsy",
 			fields: fields{
 				code:  OR,
-				left:  Value(1.0),
-				right: Value(0.0),
+				left:  Num(1.0),
+				right: Num(0.0),
 			},
 			args: args{
 				env: &Env{},
 			},
-			want: Value(1.0),
+			want: Num(1.0),
 		},
 		{
 			name: "falsy or truthy",
 			fields: fields{
 				code:  OR,
-				left:  Value(0.0),
-				right: Value(1.0),
+				left:  Num(0.0),
+				right: Num(1.0),
 			},
 			args: args{
 				env: &Env{},
 			},
-			want: Value(1.0),
+			want: Num(1.0),
 		},
 		{
 			name: "falsy or falsy",
 			fields: fields{
 				code:  AND,
-				left:  Value(0.0),
-				right: Value(0.0),
+				left:  Num(0.0),
+				right: Num(0.0),
 			},
 			args: args{
 				env: &Env{},
 			},
-			want: Value(0.0),
+			want: Num(0.0),
 		},
 		{
 			name: "invalid ops code",
 			fields: fields{
 				code:  IF,
-				left:  Value(0.0),
-				right: Value(0.0),
+				left:  Num(0.0),
+				right: Num(0.0),
 			},
 			args: args{
 				env: &Env{},
 			},
-			want: Value(0.0),
+			want: Num(0.0),
 		},
 	}
 	for _, tt := range tests {
@@ -214,7 +214,7 @@ func TestOps_Eval(t *testing.T) {
 					t.Errorf("panic %v", err)
 				}
 			}()
-			if got := e.Eval(tt.args.env); got != tt.want {
+			if got := evalNode(NewInterpreter(), e, tt.args.env); got != tt.want {
 				t.Errorf("Eval() = %v, want %v", got, tt.want)
 			}
 		})
@@ -240,26 +240,26 @@ func TestSel_Eval(t *testing.T) {
 		{
 			name: "truth testForm",
 			fields: fields{
-				testForm: Value(1.0),
-				thenForm: Value(5.0),
-				elseForm: Value(7.0),
+				testForm: Num(1.0),
+				thenForm: Num(5.0),
+				elseForm: Num(7.0),
 			},
 			args: args{
 				env: &Env{},
 			},
-			want: Value(5.0),
+			want: Num(5.0),
 		},
 		{
 			name: "falsy testForm",
 			fields: fields{
-				testForm: Value(0.0),
-				thenForm: Value(8.0),
-				elseForm: Value(12.0),
+				testForm: Num(0.0),
+				thenForm: Num(8.0),
+				elseForm: Num(12.0),
 			},
 			args: args{
 				env: &Env{},
 			},
-			want: Value(12.0),
+			want: Num(12.0),
 		},
 	}
 	for _, tt := range tests {
@@ -269,7 +269,7 @@ func TestSel_Eval(t *testing.T) {
 				thenForm: tt.fields.thenForm,
 				elseForm: tt.fields.elseForm,
 			}
-			if got := e.Eval(tt.args.env); got != tt.want {
+			if got := evalNode(NewInterpreter(), e, tt.args.env); got != tt.want {
 				t.Errorf("Eval() = %v, want %v", got, tt.want)
 			}
 		})
@@ -278,7 +278,7 @@ func TestSel_Eval(t *testing.T) {
 
 func TestTopLevel(t *testing.T) {
 	type args struct {
-		lex *Lex
+		ip *Interpreter
 	}
 	tests := []struct {
 		name  string
@@ -289,7 +289,7 @@ func TestTopLevel(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if gotR := TopLevel(tt.args.lex); gotR != tt.wantR {
+			if gotR := tt.args.ip.TopLevel(); gotR != tt.wantR {
 				t.Errorf("TopLevel() = %v, want %v", gotR, tt.wantR)
 			}
 		})
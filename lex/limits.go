@@ -0,0 +1,82 @@
+package lex
+
+import "time"
+
+// 資源の上限
+// 信頼できない式を評価するときに設定する。0 なら上限なし
+type Limits struct {
+	MaxSteps   int64         // 1つの文の評価で訪れる節の数
+	MaxNodes   int           // 1つの文の構文木の節の数
+	MaxGlobals int           // 大域変数の数
+	MaxFuncs   int           // ユーザ定義関数の数
+	Timeout    time.Duration // 1つの文の評価にかける時間
+}
+
+// 中断を調べる間隔 (歩数)
+const interruptInterval = 1024
+
+// 評価の1歩を数える
+// 構文木の節を評価するたびと、繰り返しのある組み込み関数 (range など) の1回ごとに呼ぶ。
+// そうした組み込み関数も止められるように、ときどき中断も調べる。
+// Go の関数1回で済ませる組み込み関数 (jn など) は途中で止められないので、引数の大きさを制限する
+func (ip *Interpreter) tick(pos Pos) {
+	ip.steps++
+	if ip.Limits.MaxSteps > 0 && ip.steps > ip.Limits.MaxSteps {
+		panic(&LimitError{pos, "steps", ip.Limits.MaxSteps})
+	}
+	if ip.steps%interruptInterval == 0 {
+		ip.checkInterrupt(pos)
+	}
+}
+
+// 式の入れ子の深さの上限
+// 構文解析は再帰下降なので、深すぎる入れ子は Go のスタックを使い切る。Limits を設定しなくても効く
+const maxParseDepth = 1000
+
+// 式の入れ子を1段深くする。読み終えたら leaveNesting で戻す
+func (lex *Lex) enterNesting(pos Pos) {
+	lex.depth++
+	if lex.depth > maxParseDepth {
+		panic(&LimitError{pos, "nesting", maxParseDepth})
+	}
+}
+
+func (lex *Lex) leaveNesting() {
+	lex.depth--
+}
+
+// 構文木の節を1つ数える
+func (lex *Lex) countNode(pos Pos) {
+	lex.nodes++
+	if max := lex.ip.Limits.MaxNodes; max > 0 && lex.nodes > max {
+		panic(&LimitError{pos, "nodes", max})
+	}
+}
+
+// 大域変数 (または定数) を新しく作れるか
+func (ip *Interpreter) checkGlobals(pos Pos, name Variable) {
+	max := ip.Limits.MaxGlobals
+	if max <= 0 {
+		return
+	}
+	if _, ok := ip.globalEnv[name]; !ok && len(ip.globalEnv)+len(ip.consts) >= max {
+		panic(&LimitError{pos, "globals", max})
+	}
+}
+
+// ユーザ定義関数を新しく定義できるか
+func (ip *Interpreter) checkFuncs(pos Pos) {
+	max := ip.Limits.MaxFuncs
+	if max <= 0 {
+		return
+	}
+	n := 0
+	for _, f := range ip.funcTable {
+		if _, ok := f.(*FuncU); ok {
+			n++
+		}
+	}
+	if n >= max {
+		panic(&LimitError{pos, "functions", max})
+	}
+}
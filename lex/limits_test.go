@@ -0,0 +1,153 @@
+package lex
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		src    string
+		want   Value
+		limit  string // 超える上限 ("" ならエラーにならない)
+	}{
+		{
+			name:   "steps in while",
+			limits: Limits{MaxSteps: 1000},
+			src:    "while 1 do 0 end",
+			limit:  "steps",
+		},
+		{
+			name:   "steps in recursion",
+			limits: Limits{MaxSteps: 1000},
+			src:    "def f(n) if n == 0 then 0 else f(n - 1) + f(n - 1) end end f(20)",
+			limit:  "steps",
+		},
+		{
+			name:   "steps in range",
+			limits: Limits{MaxSteps: 1000},
+			src:    "len(range(1e9))",
+			limit:  "steps",
+		},
+		{
+			name:   "steps within limit",
+			limits: Limits{MaxSteps: 1000},
+			src:    "a = 0; while a < 10 do a = a + 1 end; a",
+			want:   Num(10),
+		},
+		{
+			name:   "nodes",
+			limits: Limits{MaxNodes: 10},
+			src:    "1 + 2 + 3 + 4 + 5 + 6",
+			limit:  "nodes",
+		},
+		{
+			name:   "nodes per statement",
+			limits: Limits{MaxNodes: 10},
+			src:    "1 + 2 + 3; 4 + 5 + 6; 7 + 8 + 9",
+			want:   Num(24),
+		},
+		{
+			name:   "nesting",
+			limits: Limits{MaxNodes: 1000},
+			src:    strings.Repeat("(", 3000000),
+			limit:  "nesting",
+		},
+		{
+			name:  "nesting without limits",
+			src:   strings.Repeat("-", 3000000) + "1",
+			limit: "nesting",
+		},
+		{
+			name: "nesting within limit",
+			src:  strings.Repeat("[", 500) + "1" + strings.Repeat("]", 500) + " != 0",
+			want: Bool(true),
+		},
+		{
+			name:   "globals",
+			limits: Limits{MaxGlobals: 2},
+			src:    "a = 1; b = 2; c = 3",
+			limit:  "globals",
+		},
+		{
+			name:   "update existing global",
+			limits: Limits{MaxGlobals: 2},
+			src:    "a = 1; b = 2; a = 3; let c = 4 in c = 5 end",
+			want:   Num(5),
+		},
+		{
+			name:   "functions",
+			limits: Limits{MaxFuncs: 1},
+			src:    "def f(x) x end def g(x) x end 0",
+			limit:  "functions",
+		},
+		{
+			name:   "redefine function",
+			limits: Limits{MaxFuncs: 1},
+			src:    "def f(x) x end def f(x) x + 1 end f(1)",
+			want:   Num(2),
+		},
+		{
+			name:   "timeout",
+			limits: Limits{Timeout: 10 * time.Millisecond},
+			src:    "while 1 do 0 end",
+			limit:  "timeout",
+		},
+		{
+			name:   "timeout in builtin",
+			limits: Limits{Timeout: 10 * time.Millisecond},
+			src:    "len(range(3e7))",
+			limit:  "timeout",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := NewInterpreter()
+			ip.Limits = tt.limits
+			got, err := func() (Value, error) {
+				e, err := ip.Parse(tt.src)
+				if err != nil {
+					return nil, err
+				}
+				return ip.Eval(e)
+			}()
+			if tt.limit == "" {
+				if err != nil || got != tt.want {
+					t.Errorf("Eval() = %v, %v, want %v", got, err, tt.want)
+				}
+				return
+			}
+			var le *LimitError
+			if !errors.As(err, &le) {
+				t.Fatalf("error = %v, want LimitError", err)
+			}
+			if le.Limit != tt.limit {
+				t.Errorf("Limit = %v, want %v", le.Limit, tt.limit)
+			}
+			if !le.Pos.IsValid() {
+				t.Errorf("LimitError has no position")
+			}
+		})
+	}
+}
+
+// 次数の大きなベッセル関数は tick しないので、時間の上限を待たずにエラーで返る
+func TestLimits_Bessel(t *testing.T) {
+	ip := NewInterpreter()
+	ip.Limits = Limits{Timeout: 10 * time.Millisecond}
+	e, err := ip.Parse("jn(3e9, 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := ip.Eval(e); err == nil {
+		t.Errorf("Eval() error = nil, want error")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Eval() took %v, want it to respect the timeout", d)
+	}
+}
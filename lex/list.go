@@ -0,0 +1,410 @@
+package lex
+
+func init() {
+	// リストは要素ごとに比べる
+	DefineOp2(EQ, ListType, ListType, func(x, y Value) (Value, error) {
+		return boolToValue(listEqual(x.(*List), y.(*List))), nil
+	})
+	DefineOp2(NE, ListType, ListType, func(x, y Value) (Value, error) {
+		return boolToValue(!listEqual(x.(*List), y.(*List))), nil
+	})
+	// 連結
+	DefineOp2('+', ListType, ListType, func(x, y Value) (Value, error) {
+		xs, ys := x.(*List).elems, y.(*List).elems
+		elems := make([]Value, 0, len(xs)+len(ys))
+		return newList(append(append(elems, xs...), ys...)), nil
+	})
+}
+
+func listEqual(xs, ys *List) bool {
+	return nestedEqual(xs, ys, nil)
+}
+
+// 比べている途中のリストや連想配列の組
+type eqPair struct {
+	x, y Value
+}
+
+// x == y
+// path は比べている途中の組。自分自身を含むリストや連想配列は、同じ組をもう一度比べるところで等しいとみなす
+func nestedEqual(x, y Value, path []eqPair) bool {
+	xs, okx := x.(*List)
+	ys, oky := y.(*List)
+	m1, okm1 := x.(*Map)
+	m2, okm2 := y.(*Map)
+	if !(okx && oky) && !(okm1 && okm2) {
+		v, err := applyOp2(EQ, x, y)
+		return err == nil && isTrue(v)
+	}
+	p := eqPair{x, y}
+	for _, q := range path {
+		if q == p {
+			return true
+		}
+	}
+	if len(path) >= maxNesting {
+		panic(runtimeError(Pos{}, "==: %v nested too deeply", x.Type()))
+	}
+	path = append(path, p)
+	if okm1 {
+		if len(m1.keys) != len(m2.keys) {
+			return false
+		}
+		for _, k := range m1.keys {
+			v, ok := m2.vals[k]
+			if !ok || !nestedEqual(m1.vals[k], v, path) {
+				return false
+			}
+		}
+		return true
+	}
+	if len(xs.elems) != len(ys.elems) {
+		return false
+	}
+	for i := range xs.elems {
+		if !nestedEqual(xs.elems[i], ys.elems[i], path) {
+			return false
+		}
+	}
+	return true
+}
+
+// リストの生成 [a, b, c]
+type ListExpr struct {
+	span
+	elems []Expr
+}
+
+func newListExpr(elems []Expr) *ListExpr {
+	return &ListExpr{elems: elems}
+}
+
+// 評価するたびに新しいリストを作る
+func (e *ListExpr) Eval(ip *Interpreter, env *Env) Value {
+	ip.tick(e.start)
+	elems := make([]Value, len(e.elems))
+	for i, x := range e.elems {
+		elems[i] = x.Eval(ip, env)
+	}
+	return newList(elems)
+}
+
+// リストの処理
+func makeList(lex *Lex) Expr {
+	elems := make([]Expr, 0)
+	if lex.Token == ']' {
+		lex.getToken()
+		return newListExpr(elems)
+	}
+	for {
+		elems = append(elems, expression(lex))
+		switch lex.Token {
+		case ']':
+			lex.getToken()
+			return newListExpr(elems)
+		case ',':
+			lex.getToken()
+		default:
+			panic(lex.syntaxError("',' or ']' expected"))
+		}
+	}
+}
+
+// 添字 xs[i]
+type Index struct {
+	span
+	expr, index Expr
+}
+
+func newIndex(expr, index Expr) *Index {
+	return &Index{expr: expr, index: index}
+}
+
+// 添字の評価 (負の添字は末尾から数える)
+func (e *Index) Eval(ip *Interpreter, env *Env) Value {
+	ip.tick(e.start)
+	x := e.expr.Eval(ip, env)
+	i := e.index.Eval(ip, env)
+	return e.get(x, i)
+}
+
+func (e *Index) get(x, i Value) Value {
+	defer locate(e.start)
+	return index(x, i)
+}
+
+func index(x, i Value) Value {
+	switch x := x.(type) {
+	case *List:
+		return x.elems[normIndex(i, len(x.elems))]
+	case Str:
+		s := []rune(string(x))
+		return Str(s[normIndex(i, len(s))])
+	case *Map:
+		return x.get(i)
+	default:
+		panic(runtimeError(Pos{}, "cannot index %v", x.Type()))
+	}
+}
+
+// 範囲外ならエラー
+func normIndex(v Value, n int) int {
+	i := toIndex(v)
+	if i < 0 {
+		i += n
+	}
+	if i < 0 || i >= n {
+		panic(runtimeError(Pos{}, "index out of range: %v (length %d)", v, n))
+	}
+	return i
+}
+
+// 部分列 xs[lo:hi]
+type Slice struct {
+	span
+	expr, lo, hi Expr // 省略した lo, hi は nil
+}
+
+func newSlice(expr, lo, hi Expr) *Slice {
+	return &Slice{expr: expr, lo: lo, hi: hi}
+}
+
+// 部分列の評価 (範囲は先頭と末尾で切り詰める)
+func (e *Slice) Eval(ip *Interpreter, env *Env) Value {
+	ip.tick(e.start)
+	x := e.expr.Eval(ip, env)
+	var lo, hi Value
+	if e.lo != nil {
+		lo = e.lo.Eval(ip, env)
+	}
+	if e.hi != nil {
+		hi = e.hi.Eval(ip, env)
+	}
+	return e.get(x, lo, hi)
+}
+
+// 省略した lo, hi は nil
+func (e *Slice) get(x, lo, hi Value) Value {
+	defer locate(e.start)
+	switch x := x.(type) {
+	case *List:
+		i, j := sliceBounds(lo, hi, len(x.elems))
+		elems := make([]Value, j-i)
+		copy(elems, x.elems[i:j])
+		return newList(elems)
+	case Str:
+		s := []rune(string(x))
+		i, j := sliceBounds(lo, hi, len(s))
+		return Str(s[i:j])
+	default:
+		panic(runtimeError(Pos{}, "cannot slice %v", x.Type()))
+	}
+}
+
+func sliceBounds(lo, hi Value, n int) (int, int) {
+	bound := func(v Value, def int) int {
+		if v == nil {
+			return def
+		}
+		i := toIndex(v)
+		if i < 0 {
+			i += n
+		}
+		if i < 0 {
+			return 0
+		}
+		if i > n {
+			return n
+		}
+		return i
+	}
+	i, j := bound(lo, 0), bound(hi, n)
+	if i > j {
+		j = i
+	}
+	return i, j
+}
+
+// 添字の処理 [i] または [lo:hi]
+func makeIndex(lex *Lex, e Expr) Expr {
+	var lo Expr
+	if lex.Token != ':' {
+		lo = expression(lex)
+		if lex.Token == ']' {
+			lex.getToken()
+			return newIndex(e, lo)
+		}
+	}
+	if lex.Token != ':' {
+		panic(lex.syntaxError("':' or ']' expected"))
+	}
+	lex.getToken()
+	var hi Expr
+	if lex.Token != ']' {
+		hi = expression(lex)
+	}
+	if lex.Token != ']' {
+		panic(lex.syntaxError("']' expected"))
+	}
+	lex.getToken()
+	return newSlice(e, lo, hi)
+}
+
+// 要素への代入 xs[i] = v
+type IndexAgn struct {
+	span
+	target *Index
+	code   rune // 複合代入の演算子 (= なら 0)
+	expr   Expr
+}
+
+func newIndexAgn(target *Index, e Expr) *IndexAgn {
+	return &IndexAgn{target: target, expr: e}
+}
+
+func (a *IndexAgn) Eval(ip *Interpreter, env *Env) Value {
+	ip.tick(a.start)
+	x := a.target.expr.Eval(ip, env)
+	i := a.target.index.Eval(ip, env)
+	return a.set(x, i, a.expr.Eval(ip, env))
+}
+
+func (a *IndexAgn) set(x, i, val Value) Value {
+	defer locate(a.start)
+	if a.code != 0 {
+		v, err := applyOp2(a.code, index(x, i), val)
+		if err != nil {
+			panic(runtimeError(Pos{}, "%v", err))
+		}
+		val = v
+	}
+	switch x := x.(type) {
+	case *List:
+		x.elems[normIndex(i, len(x.elems))] = val
+	case *Map:
+		x.set(i, val)
+	default:
+		panic(runtimeError(Pos{}, "cannot assign to element of %v", x.Type()))
+	}
+	return val
+}
+
+// リストの組み込み関数
+func initListFunc() {
+	builtinTable["push"] = FuncV{2, false, push}
+	builtinTable["range"] = FuncV{1, true, rangeList}
+	builtinTable["map"] = FuncV{2, false, mapList}
+	builtinTable["filter"] = FuncV{2, false, filterList}
+	builtinTable["reduce"] = FuncV{3, false, reduceList}
+	builtinTable["sum"] = FuncV{1, false, sumList}
+	// min(xs), min(a, b, ...) のどちらでも使える
+	builtinTable["min"] = FuncV{1, true, func(ip *Interpreter, xs []Value) Value {
+		return selectValues(listOrArgs(xs), "min", LT)
+	}}
+	builtinTable["max"] = FuncV{1, true, func(ip *Interpreter, xs []Value) Value {
+		return selectValues(listOrArgs(xs), "max", GT)
+	}}
+}
+
+// push(xs, v): 末尾に追加して xs を返す
+func push(ip *Interpreter, xs []Value) Value {
+	l := toList(xs[0])
+	l.elems = append(l.elems, xs[1])
+	return l
+}
+
+// range(n), range(a, b), range(a, b, step): 等差数列のリスト (b は含まない)
+func rangeList(ip *Interpreter, xs []Value) Value {
+	var a, b, step float64 = 0, 0, 1
+	switch len(xs) {
+	case 1:
+		b = toNum(xs[0])
+	case 2:
+		a, b = toNum(xs[0]), toNum(xs[1])
+	case 3:
+		a, b, step = toNum(xs[0]), toNum(xs[1]), toNum(xs[2])
+	default:
+		panic(runtimeError(Pos{}, "range: too many arguments"))
+	}
+	if step == 0 {
+		panic(runtimeError(Pos{}, "range: step must not be zero"))
+	}
+	elems := make([]Value, 0)
+	for x := a; (step > 0 && x < b) || (step < 0 && x > b); x += step {
+		ip.tick(Pos{})
+		elems = append(elems, Num(x))
+	}
+	return newList(elems)
+}
+
+// map(f, xs): 各要素に f を適用したリスト
+func mapList(ip *Interpreter, xs []Value) Value {
+	f, l := toFunc(xs[0]), toList(xs[1])
+	elems := make([]Value, len(l.elems))
+	for i, x := range l.elems {
+		elems[i] = ip.call(f, []Value{x})
+	}
+	return newList(elems)
+}
+
+// filter(f, xs): f が真を返す要素のリスト
+func filterList(ip *Interpreter, xs []Value) Value {
+	f, l := toFunc(xs[0]), toList(xs[1])
+	elems := make([]Value, 0)
+	for _, x := range l.elems {
+		if isTrue(ip.call(f, []Value{x})) {
+			elems = append(elems, x)
+		}
+	}
+	return newList(elems)
+}
+
+// reduce(f, xs, init): 左から畳み込む
+func reduceList(ip *Interpreter, xs []Value) Value {
+	f, l, acc := toFunc(xs[0]), toList(xs[1]), xs[2]
+	for _, x := range l.elems {
+		acc = ip.call(f, []Value{acc, x})
+	}
+	return acc
+}
+
+// sum(xs): 要素の和
+func sumList(ip *Interpreter, xs []Value) Value {
+	var acc Value = Num(0)
+	for _, x := range toList(xs[0]).elems {
+		v, err := applyOp2('+', acc, x)
+		if err != nil {
+			panic(runtimeError(Pos{}, "sum: %v", err))
+		}
+		acc = v
+	}
+	return acc
+}
+
+// 引数が1つのリストならその要素、そうでなければ引数の並び
+func listOrArgs(xs []Value) []Value {
+	if len(xs) == 1 {
+		if l, ok := xs[0].(*List); ok {
+			return l.elems
+		}
+	}
+	return xs
+}
+
+// 比較演算子 code で最も前に来る要素
+func selectValues(xs []Value, name string, code rune) Value {
+	if len(xs) == 0 {
+		panic(runtimeError(Pos{}, "%v: empty list", name))
+	}
+	r := xs[0]
+	for _, x := range xs[1:] {
+		v, err := applyOp2(code, x, r)
+		if err != nil {
+			panic(runtimeError(Pos{}, "%v: %v", name, err))
+		}
+		if isTrue(v) {
+			r = x
+		}
+	}
+	return r
+}
@@ -0,0 +1,201 @@
+package lex
+
+import (
+	"reflect"
+	"testing"
+)
+
+// 数値のリストを作る
+func nums(xs ...float64) *List {
+	elems := make([]Value, len(xs))
+	for i, x := range xs {
+		elems[i] = Num(x)
+	}
+	return newList(elems)
+}
+
+func TestList(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    Value
+		wantErr bool
+	}{
+		{
+			name: "literal",
+			src:  "[1, 1 + 1, 3]",
+			want: nums(1, 2, 3),
+		},
+		{
+			name: "empty",
+			src:  "[]",
+			want: nums(),
+		},
+		{
+			name: "index",
+			src:  "xs = [10, 20, 30]; xs[1]",
+			want: Num(20),
+		},
+		{
+			name: "negative index",
+			src:  "xs = [10, 20, 30]; xs[-1]",
+			want: Num(30),
+		},
+		{
+			name: "slice",
+			src:  "xs = [10, 20, 30, 40]; xs[1:3]",
+			want: nums(20, 30),
+		},
+		{
+			name: "slice open",
+			src:  "xs = [10, 20, 30, 40]; xs[:-2] + xs[3:]",
+			want: nums(10, 20, 40),
+		},
+		{
+			name: "assign element",
+			src:  "xs = [1, 2, 3]; xs[0] = 5; xs",
+			want: nums(5, 2, 3),
+		},
+		{
+			name: "nested",
+			src:  "m = [[1, 2], [3, 4]]; m[1][0]",
+			want: Num(3),
+		},
+		{
+			name: "len",
+			src:  "len([1, 2, 3])",
+			want: Num(3),
+		},
+		{
+			name: "push",
+			src:  "xs = []; push(xs, 1); push(xs, 2); xs",
+			want: nums(1, 2),
+		},
+		{
+			name: "range",
+			src:  "range(4)",
+			want: nums(0, 1, 2, 3),
+		},
+		{
+			name: "range step",
+			src:  "range(10, 0, -3)",
+			want: nums(10, 7, 4, 1),
+		},
+		{
+			name: "map",
+			src:  "def sq(x) x * x end map(sq, [1, 2, 3])",
+			want: nums(1, 4, 9),
+		},
+		{
+			name: "map builtin",
+			src:  "map(sqrt, [1, 4, 9])",
+			want: nums(1, 2, 3),
+		},
+		{
+			name: "filter",
+			src:  "def pos(x) x > 0 end filter(pos, [-1, 2, 0, 3])",
+			want: nums(2, 3),
+		},
+		{
+			name: "reduce",
+			src:  "def mul(a, b) a * b end reduce(mul, range(1, 6), 1)",
+			want: Num(120),
+		},
+		{
+			name: "sum",
+			src:  "sum(range(1, 101))",
+			want: Num(5050),
+		},
+		{
+			name: "min",
+			src:  "min([3, 1, 2])",
+			want: Num(1),
+		},
+		{
+			name: "max",
+			src:  "max([3, 1, 2])",
+			want: Num(3),
+		},
+		{
+			name: "equal",
+			src:  "[1, [2, 3]] == [1, [2, 3]]",
+			want: Bool(true),
+		},
+		{
+			name: "self-referencing list",
+			src:  "xs = [1]; push(xs, xs); str(xs)",
+			want: Str("[1, [...]]"),
+		},
+		{
+			name: "shared list",
+			src:  "xs = [1]; str([xs, xs])",
+			want: Str("[[1], [1]]"),
+		},
+		{
+			name: "self-referencing lists are equal",
+			src:  "xs = [1]; push(xs, xs); ys = [1]; push(ys, ys); [xs == ys, xs == xs, xs != ys]",
+			want: newList([]Value{Bool(true), Bool(true), Bool(false)}),
+		},
+		{
+			name: "self-referencing lists differ",
+			src:  "xs = [1]; push(xs, xs); ys = [2]; push(ys, ys); xs == ys",
+			want: Bool(false),
+		},
+		{
+			name: "deeply nested list",
+			src:  "xs = []; for i in range(20000) do xs = [xs] end; len(str(xs))",
+			want: Num(2*maxNesting + 5),
+		},
+		{
+			name:    "deeply nested lists",
+			src:     "xs = []; ys = []; for i in range(20000) do xs = [xs], ys = [ys] end; xs == ys",
+			wantErr: true,
+		},
+		{
+			name:    "out of range",
+			src:     "[1, 2][2]",
+			wantErr: true,
+		},
+		{
+			name:    "non integer index",
+			src:     "[1, 2][0.5]",
+			wantErr: true,
+		},
+		{
+			name: "min of arguments",
+			src:  "min(3, 1, 2)",
+			want: Num(1),
+		},
+		{
+			name: "max of arguments",
+			src:  `max("b", "c", "a")`,
+			want: Str("c"),
+		},
+		{
+			name: "max of one number",
+			src:  "max(4)",
+			want: Num(4),
+		},
+		{
+			name:    "min of empty list",
+			src:     "min([])",
+			wantErr: true,
+		},
+		{
+			name:    "map with wrong arity",
+			src:     "map(atan2, [1])",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := evalString(tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Eval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,8 +1,9 @@
 package lex
 
-import "fmt"
+import "text/scanner"
 
 type Bgn struct {
+	span
 	body []Expr
 }
 
@@ -27,32 +28,33 @@ func getBody(lex *Lex) []Expr {
 
 func makeBegin(lex *Lex) Expr {
 	if lex.Token == END {
-		panic(fmt.Errorf("invalid begin form"))
+		panic(lex.syntaxError("invalid begin form"))
 	}
 	body := getBody(lex)
 	if lex.Token != END {
-		panic(fmt.Errorf("'end' expected"))
+		panic(lex.syntaxError("'end' expected"))
 	}
 	lex.getToken()
 	return newBgn(body)
 }
 
 // beginの評価
-func (e *Bgn) Eval(env *Env) Value{
-	var r Value
-	for _, expr := range e.body{
-		r = expr.Eval(env)
+func (e *Bgn) Eval(ip *Interpreter, env *Env) Value {
+	var r Value = Num(0)
+	for _, expr := range e.body {
+		r = expr.Eval(ip, env)
 	}
 	return r
 }
 
 // while
 type Whl struct {
+	span
 	testForm, body Expr
 }
 
 func newWhl(testForm, body Expr) *Whl {
-	return &Whl{testForm, body}
+	return &Whl{testForm: testForm, body: body}
 }
 
 // while式の処理
@@ -62,20 +64,95 @@ func makeWhile(lex *Lex) Expr {
 		lex.getToken()
 		return newWhl(testForm, makeBegin(lex))
 	} else {
-		panic(fmt.Errorf("'do' expected"))
+		panic(lex.syntaxError("'do' expected"))
 	}
 }
 
-//whileの評価
-func (e *Whl) Eval(env *Env) Value{
-	for isTrue(e.testForm.Eval(env)){
-		e.body.Eval(env)
+// whileの評価
+func (e *Whl) Eval(ip *Interpreter, env *Env) Value {
+	ip.tick(e.start)
+	for isTrue(e.testForm.Eval(ip, env)) {
+		ip.checkInterrupt(e.start)
+		ip.tick(e.start)
+		e.body.Eval(ip, env)
 	}
-	return Value(0.0)
+	return Num(0)
+}
+
+// for
+type For struct {
+	span
+	name Variable
+	seq  Expr
+	body Expr
+}
+
+func newFor(name Variable, seq, body Expr) *For {
+	return &For{name: name, seq: seq, body: body}
+}
+
+// for式の処理
+// for 変数 in 式 do 本体 end
+func makeFor(lex *Lex) Expr {
+	if lex.Token != scanner.Ident {
+		panic(lex.syntaxError("for: variable expected"))
+	}
+	name := Variable(lex.TokenText())
+	lex.getToken()
+	if lex.Token != IN {
+		panic(lex.syntaxError("'in' expected"))
+	}
+	lex.getToken()
+	seq := expression(lex)
+	if lex.Token != DO {
+		panic(lex.syntaxError("'do' expected"))
+	}
+	lex.getToken()
+	scope := lex.pushLocals(name)
+	body := makeBegin(lex)
+	lex.popLocals(scope)
+	return newFor(name, seq, body)
+}
+
+// forの評価
+// リストは要素、連想配列はキー、文字列は1文字ずつ局所変数に束縛する
+func (e *For) Eval(ip *Interpreter, env *Env) Value {
+	ip.tick(e.start)
+	elems := e.elems(e.seq.Eval(ip, env))
+	env = makeEnv(1, env)
+	env.vals[0] = Nil{}
+	for _, x := range elems {
+		ip.checkInterrupt(e.start)
+		ip.tick(e.start)
+		env.vals[0] = x
+		e.body.Eval(ip, env)
+	}
+	return Num(0)
+}
+
+// 繰り返す値の列 (評価中に seq を変えても影響しないように複製する)
+func (e *For) elems(seq Value) []Value {
+	var elems []Value
+	switch seq := seq.(type) {
+	case *List:
+		elems = make([]Value, len(seq.elems))
+		copy(elems, seq.elems)
+	case *Map:
+		elems = make([]Value, len(seq.keys))
+		copy(elems, seq.keys)
+	case Str:
+		for _, c := range string(seq) {
+			elems = append(elems, Str(c))
+		}
+	default:
+		panic(runtimeError(e.start, "cannot iterate over %v", seq.Type()))
+	}
+	return elems
 }
 
 // let
 type Let struct {
+	span
 	vars []Variable
 	vals []Expr
 	body Expr
@@ -85,38 +162,51 @@ func newLet(vars []Variable, vals []Expr, body Expr) *Let {
 	return &Let{vars: vars, vals: vals, body: body}
 }
 
+// let 変数 = 式, ... in 本体 end
+// 式では前に束縛した変数を参照できる
 func makeLet(lex *Lex) Expr {
 	vars := make([]Variable, 0)
 	vals := make([]Expr, 0)
+	// 式を読む前に環境を作り、束縛した順に変数を加える
+	scope := lex.pushLocals()
 	for {
-
-		e := expression(lex)
-		a, ok := e.(*Agn)
-		if !ok {
-			panic(fmt.Errorf("let : invalid assign form"))
+		if lex.Token != scanner.Ident {
+			panic(lex.syntaxError("let : invalid assign form"))
+		}
+		name := Variable(lex.TokenText())
+		lex.getToken()
+		if lex.Token != '=' {
+			panic(lex.syntaxError("let : invalid assign form"))
 		}
-		vars  =append(vars, a.name)
-		vals = append(vals, a.expr)
-		if lex.Token == IN{
+		lex.getToken()
+		vals = append(vals, expression(lex))
+		vars = append(vars, name)
+		lex.addLocal(name)
+		if lex.Token == IN {
 			break
-		} else if lex.Token != ','{
-			panic(fmt.Errorf("let: ',' expected"))
+		} else if lex.Token != ',' {
+			panic(lex.syntaxError("let: ',' expected"))
 		}
 		lex.getToken()
 	}
 	lex.getToken()
-	return newLet(vars, vals, makeBegin(lex))
+	body := makeBegin(lex)
+	lex.popLocals(scope)
+	return newLet(vars, vals, body)
 }
 
 // letの評価
-func (e *Let) Eval(env *Env) Value{
-	return e.body.Eval(addBinding(e.vars, e.vals, env))
+// 式は作った環境で評価するが、まだ束縛していない変数は参照しない (構文解析で決まる)
+func (e *Let) Eval(ip *Interpreter, env *Env) Value {
+	ip.tick(e.start)
+	return e.body.Eval(ip, e.bind(ip, env))
 }
 
-// 局所変数を環境に追加
-func addBinding(xs []Variable, es []Expr, env *Env) *Env{
-	for i := 0 ; i < len(xs); i++{
-		env = newEnv(xs[i], es[i].Eval(env), env)
+// 局所変数の環境を作って束縛する
+func (e *Let) bind(ip *Interpreter, env *Env) *Env {
+	env = makeEnv(len(e.vars), env)
+	for i, x := range e.vals {
+		env.vals[i] = x.Eval(ip, env)
 	}
 	return env
-}
\ No newline at end of file
+}
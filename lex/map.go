@@ -0,0 +1,179 @@
+package lex
+
+import (
+	"math"
+	"strings"
+)
+
+func init() {
+	DefineOp2(EQ, MapType, MapType, func(x, y Value) (Value, error) {
+		return boolToValue(mapEqual(x.(*Map), y.(*Map))), nil
+	})
+	DefineOp2(NE, MapType, MapType, func(x, y Value) (Value, error) {
+		return boolToValue(!mapEqual(x.(*Map), y.(*Map))), nil
+	})
+}
+
+// 連想配列
+// キーは文字列か数値で、追加した順に並ぶ
+type Map struct {
+	keys []Value
+	vals map[Value]Value
+}
+
+func newMap() *Map {
+	return &Map{vals: make(map[Value]Value)}
+}
+
+func (m *Map) Eval(ip *Interpreter, env *Env) Value {
+	return m
+}
+
+func (m *Map) Type() Type {
+	return MapType
+}
+
+func (m *Map) String() string {
+	var b strings.Builder
+	writeValue(&b, m, nil)
+	return b.String()
+}
+
+// キーとして使える値か調べる
+func mapKey(k Value) Value {
+	switch x := k.(type) {
+	case Str:
+		return x
+	case Num:
+		if math.IsNaN(float64(x)) {
+			panic(runtimeError(Pos{}, "invalid map key: NaN"))
+		}
+		return x
+	default:
+		panic(runtimeError(Pos{}, "invalid map key type: %v", k.Type()))
+	}
+}
+
+func (m *Map) get(k Value) Value {
+	v, ok := m.vals[mapKey(k)]
+	if !ok {
+		panic(runtimeError(Pos{}, "key not found: %v", k))
+	}
+	return v
+}
+
+func (m *Map) set(k, v Value) {
+	k = mapKey(k)
+	if _, ok := m.vals[k]; !ok {
+		m.keys = append(m.keys, k)
+	}
+	m.vals[k] = v
+}
+
+func (m *Map) delete(k Value) {
+	k = mapKey(k)
+	if _, ok := m.vals[k]; !ok {
+		return
+	}
+	delete(m.vals, k)
+	for i, x := range m.keys {
+		if x == k {
+			m.keys = append(m.keys[:i], m.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+func mapEqual(m1, m2 *Map) bool {
+	return nestedEqual(m1, m2, nil)
+}
+
+// 連想配列の生成 {k: v, ...}
+type MapExpr struct {
+	span
+	keys, vals []Expr
+}
+
+func newMapExpr(keys, vals []Expr) *MapExpr {
+	return &MapExpr{keys: keys, vals: vals}
+}
+
+// 評価するたびに新しい連想配列を作る
+func (e *MapExpr) Eval(ip *Interpreter, env *Env) Value {
+	ip.tick(e.start)
+	m := newMap()
+	for i := range e.keys {
+		k := e.keys[i].Eval(ip, env)
+		v := e.vals[i].Eval(ip, env)
+		e.set(m, k, v)
+	}
+	return m
+}
+
+func (e *MapExpr) set(m *Map, k, v Value) {
+	defer locate(e.start)
+	m.set(k, v)
+}
+
+// 連想配列の処理
+func makeMap(lex *Lex) Expr {
+	keys := make([]Expr, 0)
+	vals := make([]Expr, 0)
+	if lex.Token == '}' {
+		lex.getToken()
+		return newMapExpr(keys, vals)
+	}
+	for {
+		keys = append(keys, expression(lex))
+		if lex.Token != ':' {
+			panic(lex.syntaxError("':' expected"))
+		}
+		lex.getToken()
+		vals = append(vals, expression(lex))
+		switch lex.Token {
+		case '}':
+			lex.getToken()
+			return newMapExpr(keys, vals)
+		case ',':
+			lex.getToken()
+		default:
+			panic(lex.syntaxError("',' or '}' expected"))
+		}
+	}
+}
+
+// 連想配列の組み込み関数
+func initMapFunc() {
+	builtinTable["keys"] = FuncV{1, false, func(ip *Interpreter, xs []Value) Value {
+		m := toMap(xs[0])
+		keys := make([]Value, len(m.keys))
+		copy(keys, m.keys)
+		return newList(keys)
+	}}
+	builtinTable["values"] = FuncV{1, false, func(ip *Interpreter, xs []Value) Value {
+		m := toMap(xs[0])
+		vals := make([]Value, len(m.keys))
+		for i, k := range m.keys {
+			vals[i] = m.vals[k]
+		}
+		return newList(vals)
+	}}
+	builtinTable["has"] = FuncV{2, false, func(ip *Interpreter, xs []Value) Value {
+		_, ok := toMap(xs[0]).vals[mapKey(xs[1])]
+		return boolToValue(ok)
+	}}
+	builtinTable["delete"] = FuncV{2, false, func(ip *Interpreter, xs []Value) Value {
+		m := toMap(xs[0])
+		m.delete(xs[1])
+		return m
+	}}
+}
+
+// 連想配列を取り出す
+func toMap(v Value) *Map {
+	m, ok := v.(*Map)
+	if !ok {
+		panic(runtimeError(Pos{}, "map expected, got %v", v.Type()))
+	}
+	return m
+}
@@ -0,0 +1,135 @@
+package lex
+
+import (
+	"reflect"
+	"testing"
+)
+
+// 連想配列を作る
+func mapOf(kvs ...Value) *Map {
+	m := newMap()
+	for i := 0; i < len(kvs); i += 2 {
+		m.set(kvs[i], kvs[i+1])
+	}
+	return m
+}
+
+func TestMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    Value
+		wantErr bool
+	}{
+		{
+			name: "literal",
+			src:  `{"a": 1, "b": 1 + 1}`,
+			want: mapOf(Str("a"), Num(1), Str("b"), Num(2)),
+		},
+		{
+			name: "number key",
+			src:  `m = {1: "one", 2: "two"}; m[2]`,
+			want: Str("two"),
+		},
+		{
+			name: "lookup",
+			src:  `m = {"a": 1}; m["a"]`,
+			want: Num(1),
+		},
+		{
+			name: "field",
+			src:  `m = {"a": {"b": 2}}; m.a.b`,
+			want: Num(2),
+		},
+		{
+			name: "insert",
+			src:  `m = {}; m["x"] = 1; m.y = 2; m`,
+			want: mapOf(Str("x"), Num(1), Str("y"), Num(2)),
+		},
+		{
+			name: "delete",
+			src:  `m = {"a": 1, "b": 2}; delete(m, "a")`,
+			want: mapOf(Str("b"), Num(2)),
+		},
+		{
+			name: "keys",
+			src:  `keys({"b": 1, "a": 2})`,
+			want: newList([]Value{Str("b"), Str("a")}),
+		},
+		{
+			name: "values",
+			src:  `values({"b": 1, "a": 2})`,
+			want: nums(1, 2),
+		},
+		{
+			name: "has",
+			src:  `has({"a": 1}, "b")`,
+			want: Bool(false),
+		},
+		{
+			name: "len",
+			src:  `len({"a": 1, "b": 2})`,
+			want: Num(2),
+		},
+		{
+			name: "iterate",
+			src:  `m = {"a": 1, "b": 2}; s = 0; for k in m do s = s + m[k] end; s`,
+			want: Num(3),
+		},
+		{
+			name: "totals per category",
+			src: `t = {};
+				for r in [["a", 1], ["b", 2], ["a", 3]] do
+					if has(t, r[0]) then t[r[0]] = t[r[0]] + r[1] else t[r[0]] = r[1] end
+				end;
+				t`,
+			want: mapOf(Str("a"), Num(4), Str("b"), Num(2)),
+		},
+		{
+			name: "iterate list",
+			src:  `s = ""; for c in ["x", "y"] do s = s + c end; s`,
+			want: Str("xy"),
+		},
+		{
+			name: "self-referencing map",
+			src:  `m = {"a": 1}; m["self"] = m; m["list"] = [m]; str(m)`,
+			want: Str(`{"a": 1, "self": {...}, "list": [{...}]}`),
+		},
+		{
+			name: "self-referencing maps are equal",
+			src:  `m = {"a": 1}; m["self"] = m; n = {"a": 1}; n["self"] = n; o = {"a": 2}; o["self"] = o; [m == n, m == o]`,
+			want: newList([]Value{Bool(true), Bool(false)}),
+		},
+		{
+			name:    "deeply nested maps",
+			src:     `m = {}; n = {}; for i in range(20000) do m = {"m": m}, n = {"m": n} end; m == n`,
+			wantErr: true,
+		},
+		{
+			name:    "missing key",
+			src:     `{"a": 1}["b"]`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid key",
+			src:     `{[1]: 1}`,
+			wantErr: true,
+		},
+		{
+			name:    "iterate number",
+			src:     `for x in 1 do x end`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := evalString(tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Eval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package lex
+
+import "math"
+
+// 組み込みの定数表
+// 大域変数より先に探し、代入はできない (局所変数なら同じ名前を使える)
+var constTable = map[Variable]Value{
+	"pi":    Num(math.Pi),
+	"tau":   Num(2 * math.Pi),
+	"e":     Num(math.E),
+	"phi":   Num(math.Phi),
+	"sqrt2": Num(math.Sqrt2),
+	"ln2":   Num(math.Ln2),
+	"ln10":  Num(math.Ln10),
+	"inf":   Num(math.Inf(1)),
+	"nan":   Num(math.NaN()),
+}
+
+// 物理定数の表 (CODATA 2018 の値、SI 単位)
+// c や R のような短い名前が多いので、大域変数・外から与えた変数・関数が同じ名前なら、そちらを優先する
+var physTable = map[Variable]Value{
+	"c":     Num(299792458),         // 真空中の光速 [m/s]
+	"h":     Num(6.62607015e-34),    // プランク定数 [J s]
+	"hbar":  Num(1.054571817e-34),   // ディラック定数 [J s]
+	"k_B":   Num(1.380649e-23),      // ボルツマン定数 [J/K]
+	"N_A":   Num(6.02214076e23),     // アボガドロ定数 [1/mol]
+	"R":     Num(8.314462618),       // 気体定数 [J/(mol K)]
+	"F":     Num(96485.33212),       // ファラデー定数 [C/mol]
+	"q_e":   Num(1.602176634e-19),   // 電気素量 [C]
+	"m_e":   Num(9.1093837015e-31),  // 電子の質量 [kg]
+	"m_p":   Num(1.67262192369e-27), // 陽子の質量 [kg]
+	"m_n":   Num(1.67492749804e-27), // 中性子の質量 [kg]
+	"G":     Num(6.67430e-11),       // 万有引力定数 [m^3/(kg s^2)]
+	"g_n":   Num(9.80665),           // 標準重力加速度 [m/s^2]
+	"eps_0": Num(8.8541878128e-12),  // 真空の誘電率 [F/m]
+	"mu_0":  Num(1.25663706212e-6),  // 真空の透磁率 [N/A^2]
+	"sigma": Num(5.670374419e-8),    // シュテファン＝ボルツマン定数 [W/(m^2 K^4)]
+	"alpha": Num(7.2973525693e-3),   // 微細構造定数
+}
+
+// 数学関数の初期化
+// math パッケージの関数と整数の関数
+func initMathFunc() {
+	// 丸め
+	builtinTable["floor"] = Func1(math.Floor)
+	builtinTable["ceil"] = Func1(math.Ceil)
+	builtinTable["round"] = Func1(math.Round)
+	builtinTable["roundeven"] = Func1(math.RoundToEven)
+	builtinTable["trunc"] = Func1(math.Trunc)
+	builtinTable["mod"] = Func2(math.Mod)
+	builtinTable["remainder"] = Func2(math.Remainder)
+	builtinTable["sign"] = Func1(sign)
+	builtinTable["clamp"] = FuncV{3, false, func(ip *Interpreter, xs []Value) Value {
+		x, lo, hi := toNum(xs[0]), toNum(xs[1]), toNum(xs[2])
+		if lo > hi {
+			panic(runtimeError(Pos{}, "clamp: lower bound %v is greater than upper bound %v", lo, hi))
+		}
+		return Num(math.Max(lo, math.Min(x, hi)))
+	}}
+
+	// 累乗・対数
+	builtinTable["cbrt"] = Func1(math.Cbrt)
+	builtinTable["hypot"] = Func2(math.Hypot)
+	builtinTable["exp2"] = Func1(math.Exp2)
+	builtinTable["expm1"] = Func1(math.Expm1)
+	builtinTable["log1p"] = Func1(math.Log1p)
+	builtinTable["logb"] = Func1(math.Logb)
+	builtinTable["fma"] = FuncV{3, false, func(ip *Interpreter, xs []Value) Value {
+		return Num(math.FMA(toNum(xs[0]), toNum(xs[1]), toNum(xs[2])))
+	}}
+
+	// 双曲線関数の逆関数
+	builtinTable["asinh"] = Func1(math.Asinh)
+	builtinTable["acosh"] = Func1(math.Acosh)
+	builtinTable["atanh"] = Func1(math.Atanh)
+
+	// 特殊関数
+	builtinTable["gamma"] = Func1(math.Gamma)
+	builtinTable["lgamma"] = Func1(func(x float64) float64 {
+		y, _ := math.Lgamma(x)
+		return y
+	})
+	builtinTable["erf"] = Func1(math.Erf)
+	builtinTable["erfc"] = Func1(math.Erfc)
+	builtinTable["erfinv"] = Func1(math.Erfinv)
+	builtinTable["erfcinv"] = Func1(math.Erfcinv)
+	builtinTable["j0"] = Func1(math.J0)
+	builtinTable["j1"] = Func1(math.J1)
+	builtinTable["jn"] = FuncV{2, false, func(ip *Interpreter, xs []Value) Value {
+		return Num(math.Jn(besselOrder("jn", xs[0]), toNum(xs[1])))
+	}}
+	builtinTable["y0"] = Func1(math.Y0)
+	builtinTable["y1"] = Func1(math.Y1)
+	builtinTable["yn"] = FuncV{2, false, func(ip *Interpreter, xs []Value) Value {
+		return Num(math.Yn(besselOrder("yn", xs[0]), toNum(xs[1])))
+	}}
+
+	// 浮動小数点数
+	builtinTable["dim"] = Func2(math.Dim)
+	builtinTable["copysign"] = Func2(math.Copysign)
+	builtinTable["nextafter"] = Func2(math.Nextafter)
+	builtinTable["isnan"] = FuncV{1, false, func(ip *Interpreter, xs []Value) Value {
+		return Bool(math.IsNaN(toNum(xs[0])))
+	}}
+	builtinTable["isinf"] = FuncV{1, false, func(ip *Interpreter, xs []Value) Value {
+		return Bool(math.IsInf(toNum(xs[0]), 0))
+	}}
+
+	// 整数
+	builtinTable["gcd"] = FuncV{2, false, func(ip *Interpreter, xs []Value) Value {
+		return Num(gcd(toInt("gcd", xs[0]), toInt("gcd", xs[1])))
+	}}
+	builtinTable["lcm"] = FuncV{2, false, func(ip *Interpreter, xs []Value) Value {
+		a, b := toInt("lcm", xs[0]), toInt("lcm", xs[1])
+		if a == 0 || b == 0 {
+			return Num(0)
+		}
+		return Num(math.Abs(a / gcd(a, b) * b))
+	}}
+	builtinTable["factorial"] = FuncV{1, false, func(ip *Interpreter, xs []Value) Value {
+		n := toInt("factorial", xs[0])
+		if n < 0 {
+			panic(runtimeError(Pos{}, "factorial: negative argument %v", n))
+		}
+		// 171! 以上は float64 で表せない
+		if n > 170 {
+			return Num(math.Inf(1))
+		}
+		r := 1.0
+		for i := 2.0; i <= n; i++ {
+			r *= i
+		}
+		return Num(r)
+	}}
+	builtinTable["binomial"] = FuncV{2, false, func(ip *Interpreter, xs []Value) Value {
+		return Num(binomial(toInt("binomial", xs[0]), toInt("binomial", xs[1])))
+	}}
+}
+
+// 符号 (-1, 0, 1)
+func sign(x float64) float64 {
+	switch {
+	case x > 0:
+		return 1
+	case x < 0:
+		return -1
+	}
+	return x // 0, -0, NaN
+}
+
+// 整数の値を取り出す
+// float64 のまま扱うので int の範囲を超えてもよい
+func toInt(name string, v Value) float64 {
+	x := toNum(v)
+	if x != math.Trunc(x) || math.IsInf(x, 0) {
+		panic(runtimeError(Pos{}, "%v: integer expected, got %v", name, x))
+	}
+	return x
+}
+
+// jn・yn の次数の上限
+// math.Jn・math.Yn は次数に比例する時間がかかり、途中で tick できないので大きな次数は断る
+const maxBesselOrder = 1000000
+
+// ベッセル関数の次数
+func besselOrder(name string, v Value) int {
+	n := toIndex(v)
+	if n > maxBesselOrder || n < -maxBesselOrder {
+		panic(runtimeError(Pos{}, "%s: order %v is too large (max %v)", name, n, maxBesselOrder))
+	}
+	return n
+}
+
+// 最大公約数 (ユークリッドの互除法)
+func gcd(a, b float64) float64 {
+	a, b = math.Abs(a), math.Abs(b)
+	for b != 0 {
+		a, b = b, math.Mod(a, b)
+	}
+	return a
+}
+
+// 二項係数 nCk
+// r は単調に増えるので、溢れたらそこで止める (k が大きくても 1100 回ほどで溢れる)
+func binomial(n, k float64) float64 {
+	if k < 0 || k > n {
+		return 0
+	}
+	if k > n-k {
+		k = n - k
+	}
+	r := 1.0
+	for i := 1.0; i <= k; i++ {
+		r = r * (n - k + i) / i
+		if math.IsInf(r, 1) {
+			return r
+		}
+	}
+	return math.Round(r)
+}
@@ -0,0 +1,442 @@
+package lex
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMathFunc_Eval(t *testing.T) {
+	type fields struct {
+		fn string
+		xs []Expr
+	}
+	tests := []struct {
+		name   string
+		fields fields
+		want   Value
+	}{
+		{
+			name: "floor",
+			fields: fields{
+				fn: "floor",
+				xs: []Expr{Num(-1.5)},
+			},
+			want: Num(-2),
+		},
+		{
+			name: "ceil",
+			fields: fields{
+				fn: "ceil",
+				xs: []Expr{Num(-1.5)},
+			},
+			want: Num(-1),
+		},
+		{
+			name: "round",
+			fields: fields{
+				fn: "round",
+				xs: []Expr{Num(2.5)},
+			},
+			want: Num(3),
+		},
+		{
+			name: "roundeven",
+			fields: fields{
+				fn: "roundeven",
+				xs: []Expr{Num(2.5)},
+			},
+			want: Num(2),
+		},
+		{
+			name: "trunc",
+			fields: fields{
+				fn: "trunc",
+				xs: []Expr{Num(-2.7)},
+			},
+			want: Num(-2),
+		},
+		{
+			name: "mod",
+			fields: fields{
+				fn: "mod",
+				xs: []Expr{Num(7), Num(-3)},
+			},
+			want: Num(1),
+		},
+		{
+			name: "remainder",
+			fields: fields{
+				fn: "remainder",
+				xs: []Expr{Num(7), Num(4)},
+			},
+			want: Num(-1),
+		},
+		{
+			name: "sign",
+			fields: fields{
+				fn: "sign",
+				xs: []Expr{Num(-0.5)},
+			},
+			want: Num(-1),
+		},
+		{
+			name: "clamp",
+			fields: fields{
+				fn: "clamp",
+				xs: []Expr{Num(12), Num(0), Num(10)},
+			},
+			want: Num(10),
+		},
+		{
+			name: "cbrt",
+			fields: fields{
+				fn: "cbrt",
+				xs: []Expr{Num(27)},
+			},
+			want: Num(3),
+		},
+		{
+			name: "hypot",
+			fields: fields{
+				fn: "hypot",
+				xs: []Expr{Num(3), Num(4)},
+			},
+			want: Num(5),
+		},
+		{
+			name: "exp2",
+			fields: fields{
+				fn: "exp2",
+				xs: []Expr{Num(10)},
+			},
+			want: Num(1024),
+		},
+		{
+			name: "expm1",
+			fields: fields{
+				fn: "expm1",
+				xs: []Expr{Num(0)},
+			},
+			want: Num(0),
+		},
+		{
+			name: "log1p",
+			fields: fields{
+				fn: "log1p",
+				xs: []Expr{Num(0)},
+			},
+			want: Num(0),
+		},
+		{
+			name: "logb",
+			fields: fields{
+				fn: "logb",
+				xs: []Expr{Num(8)},
+			},
+			want: Num(3),
+		},
+		{
+			name: "fma",
+			fields: fields{
+				fn: "fma",
+				xs: []Expr{Num(2), Num(3), Num(4)},
+			},
+			want: Num(10),
+		},
+		{
+			name: "asinh",
+			fields: fields{
+				fn: "asinh",
+				xs: []Expr{Num(0)},
+			},
+			want: Num(0),
+		},
+		{
+			name: "acosh",
+			fields: fields{
+				fn: "acosh",
+				xs: []Expr{Num(1)},
+			},
+			want: Num(0),
+		},
+		{
+			name: "atanh",
+			fields: fields{
+				fn: "atanh",
+				xs: []Expr{Num(0)},
+			},
+			want: Num(0),
+		},
+		{
+			name: "gamma",
+			fields: fields{
+				fn: "gamma",
+				xs: []Expr{Num(5)},
+			},
+			want: Num(24),
+		},
+		{
+			name: "lgamma",
+			fields: fields{
+				fn: "lgamma",
+				xs: []Expr{Num(1)},
+			},
+			want: Num(0),
+		},
+		{
+			name: "erf",
+			fields: fields{
+				fn: "erf",
+				xs: []Expr{Num(0.5)},
+			},
+			want: Num(math.Erf(0.5)),
+		},
+		{
+			name: "erfc",
+			fields: fields{
+				fn: "erfc",
+				xs: []Expr{Num(0)},
+			},
+			want: Num(1),
+		},
+		{
+			name: "erfinv",
+			fields: fields{
+				fn: "erfinv",
+				xs: []Expr{Num(0)},
+			},
+			want: Num(0),
+		},
+		{
+			name: "erfcinv",
+			fields: fields{
+				fn: "erfcinv",
+				xs: []Expr{Num(1)},
+			},
+			want: Num(0),
+		},
+		{
+			name: "j0",
+			fields: fields{
+				fn: "j0",
+				xs: []Expr{Num(0)},
+			},
+			want: Num(1),
+		},
+		{
+			name: "j1",
+			fields: fields{
+				fn: "j1",
+				xs: []Expr{Num(0)},
+			},
+			want: Num(0),
+		},
+		{
+			name: "jn",
+			fields: fields{
+				fn: "jn",
+				xs: []Expr{Num(2), Num(1.5)},
+			},
+			want: Num(math.Jn(2, 1.5)),
+		},
+		{
+			name: "y0",
+			fields: fields{
+				fn: "y0",
+				xs: []Expr{Num(1)},
+			},
+			want: Num(math.Y0(1)),
+		},
+		{
+			name: "y1",
+			fields: fields{
+				fn: "y1",
+				xs: []Expr{Num(1)},
+			},
+			want: Num(math.Y1(1)),
+		},
+		{
+			name: "yn",
+			fields: fields{
+				fn: "yn",
+				xs: []Expr{Num(2), Num(1.5)},
+			},
+			want: Num(math.Yn(2, 1.5)),
+		},
+		{
+			name: "dim",
+			fields: fields{
+				fn: "dim",
+				xs: []Expr{Num(2), Num(5)},
+			},
+			want: Num(0),
+		},
+		{
+			name: "copysign",
+			fields: fields{
+				fn: "copysign",
+				xs: []Expr{Num(3), Num(-1)},
+			},
+			want: Num(-3),
+		},
+		{
+			name: "nextafter",
+			fields: fields{
+				fn: "nextafter",
+				xs: []Expr{Num(1), Num(2)},
+			},
+			want: Num(math.Nextafter(1, 2)),
+		},
+		{
+			name: "isnan",
+			fields: fields{
+				fn: "isnan",
+				xs: []Expr{Num(math.NaN())},
+			},
+			want: Bool(true),
+		},
+		{
+			name: "isinf",
+			fields: fields{
+				fn: "isinf",
+				xs: []Expr{Num(math.Inf(-1))},
+			},
+			want: Bool(true),
+		},
+		{
+			name: "gcd",
+			fields: fields{
+				fn: "gcd",
+				xs: []Expr{Num(12), Num(-18)},
+			},
+			want: Num(6),
+		},
+		{
+			name: "lcm",
+			fields: fields{
+				fn: "lcm",
+				xs: []Expr{Num(4), Num(6)},
+			},
+			want: Num(12),
+		},
+		{
+			name: "factorial",
+			fields: fields{
+				fn: "factorial",
+				xs: []Expr{Num(10)},
+			},
+			want: Num(3628800),
+		},
+		{
+			name: "factorial2",
+			fields: fields{
+				fn: "factorial",
+				xs: []Expr{Num(0)},
+			},
+			want: Num(1),
+		},
+		{
+			name: "binomial",
+			fields: fields{
+				fn: "binomial",
+				xs: []Expr{Num(10), Num(3)},
+			},
+			want: Num(120),
+		},
+		{
+			name: "binomial2",
+			fields: fields{
+				fn: "binomial",
+				xs: []Expr{Num(52), Num(5)},
+			},
+			want: Num(2598960),
+		},
+		{
+			name: "binomial3",
+			fields: fields{
+				fn: "binomial",
+				xs: []Expr{Num(3), Num(5)},
+			},
+			want: Num(0),
+		},
+		{
+			name: "binomial overflow",
+			fields: fields{
+				fn: "binomial",
+				xs: []Expr{Num(1e12), Num(5e11)},
+			},
+			want: Num(math.Inf(1)),
+		},
+		{
+			name: "min",
+			fields: fields{
+				fn: "min",
+				xs: []Expr{Num(3), Num(1), Num(2)},
+			},
+			want: Num(1),
+		},
+		{
+			name: "max",
+			fields: fields{
+				fn: "max",
+				xs: []Expr{Num(3), Num(1), Num(2)},
+			},
+			want: Num(3),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &App{
+				fn: builtinTable[tt.fields.fn],
+				xs: tt.fields.xs,
+			}
+			if got := a.Eval(NewInterpreter(), nil); got != tt.want {
+				t.Errorf("Eval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMathFunc_Error(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{name: "gcd of non-integer", src: "gcd(1.5, 3)"},
+		{name: "negative factorial", src: "factorial(-1)"},
+		{name: "clamp bounds", src: "clamp(1, 2, 0)"},
+		{name: "jn order", src: "jn(0.5, 1)"},
+		{name: "jn order too large", src: "jn(3e9, 1)"},
+		{name: "yn order too large", src: "yn(-3e9, 1)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := evalString(tt.src); err == nil {
+				t.Errorf("error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestConstTable(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want Value
+	}{
+		{name: "pi", src: "pi", want: Num(math.Pi)},
+		{name: "e", src: "log(e)", want: Num(1)},
+		{name: "inf", src: "-inf < 0", want: Bool(true)},
+		{name: "nan", src: "isnan(nan)", want: Bool(true)},
+		{name: "local shadows constant", src: "let pi = 3 in pi end", want: Num(3)},
+		{name: "in function", src: "def area(r) pi * r * r end area(1)", want: Num(math.Pi)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := evalString(tt.src)
+			if err != nil || got != tt.want {
+				t.Errorf("Eval() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
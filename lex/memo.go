@@ -0,0 +1,315 @@
+package lex
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 結果を覚える関数 (memo def)
+// 大域変数を読み書きしない関数は、同じ引数なら同じ値を返すので、
+// 引数と結果がすべて数、文字列、真偽値、nil のときは結果を覚えておいて本体を評価しない。
+// リストや連想配列、関数値を渡したときは覚えない (中身が変わることがある)
+
+// 覚えておいた結果
+// Program を並行に実行すると共有するので mu で守る
+type memoTable struct {
+	mu           sync.Mutex
+	vals         map[string]Value
+	hits, misses int
+}
+
+func newMemoTable() *memoTable {
+	return &memoTable{vals: make(map[string]Value)}
+}
+
+func (t *memoTable) lookUp(key string) (Value, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v, ok := t.vals[key]
+	if ok {
+		t.hits++
+	} else {
+		t.misses++
+	}
+	return v, ok
+}
+
+func (t *memoTable) store(key string, v Value) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.vals[key] = v
+}
+
+// 覚えておいた結果を捨てる
+// 捨てた結果の数を返す
+func (t *memoTable) clear() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := len(t.vals)
+	t.vals = make(map[string]Value)
+	t.hits, t.misses = 0, 0
+	return n
+}
+
+func (t *memoTable) stats() *Map {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := newMap()
+	m.set(Str("entries"), Num(len(t.vals)))
+	m.set(Str("hits"), Num(t.hits))
+	m.set(Str("misses"), Num(t.misses))
+	return m
+}
+
+// 引数の組を表す文字列
+// 覚えられない値があれば ok は false
+func memoKey(xs []Value) (string, bool) {
+	var b strings.Builder
+	for _, x := range xs {
+		switch x := x.(type) {
+		case Num:
+			// -0 と 0 は別の引数 (1 / x が違う)、NaN はすべて同じ引数とする
+			f := float64(x)
+			if math.IsNaN(f) {
+				f = math.NaN()
+			}
+			b.WriteByte('n')
+			b.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+		case Str:
+			b.WriteByte('s')
+			b.WriteString(strconv.Itoa(len(x)))
+			b.WriteByte(':')
+			b.WriteString(string(x))
+		case Bool:
+			if x {
+				b.WriteByte('t')
+			} else {
+				b.WriteByte('f')
+			}
+		case Nil:
+			b.WriteByte('z')
+		default:
+			return "", false
+		}
+		b.WriteByte(',')
+	}
+	return b.String(), true
+}
+
+// 結果を覚える呼び出し
+type memoEntry struct {
+	t   *memoTable
+	key string
+}
+
+// 戻ったら結果を覚える呼び出しの列
+// 末尾呼び出しで置き換えた関数も同じ値を返すので、まとめて覚える
+type memoPending []memoEntry
+
+// env の引数で f に入る
+// 覚えておいた結果があればそれを返す。なければ戻ったときに覚えるよう加えておく
+func (p *memoPending) enter(f *FuncU, env *Env) (Value, bool) {
+	if f.memo == nil {
+		return nil, false
+	}
+	key, ok := memoKey(env.vals)
+	if !ok {
+		return nil, false
+	}
+	if v, ok := f.memo.lookUp(key); ok {
+		return v, true
+	}
+	*p = append(*p, memoEntry{f.memo, key})
+	return nil, false
+}
+
+// 戻った値 v を覚える
+func (p memoPending) store(v Value) {
+	if !isConst(v) {
+		return
+	}
+	for _, e := range p {
+		e.t.store(e.key, v)
+	}
+}
+
+// memo def で定義する関数 f の本体 body が大域変数を読み書きしないか調べる
+// 呼び出すユーザ定義関数の本体も調べる。宣言だけの関数は定義したときに調べ直す。
+// 読めるのは定数と関数名だけ
+func (ip *Interpreter) checkPure(f *FuncU, body Expr) (err error) {
+	defer catch(&err)
+	c := &pureCheck{ip: ip, name: f.name, seen: map[*FuncU]bool{f: true}}
+	c.body(f.name, body)
+	return nil
+}
+
+type pureCheck struct {
+	ip   *Interpreter
+	name string // memo def で定義する関数
+	fn   string // 調べている本体の関数
+	seen map[*FuncU]bool
+}
+
+func (c *pureCheck) body(fn string, body Expr) {
+	save := c.fn
+	c.fn = fn
+	c.walk(body)
+	c.fn = save
+}
+
+func (c *pureCheck) fail(pos Pos, verb string, name Variable) {
+	panic(&SyntaxError{pos, fmt.Sprintf("memo %v: %v %v global variable %v", c.name, c.fn, verb, name)})
+}
+
+// 呼び出すユーザ定義関数を調べる
+func (c *pureCheck) call(f Func) {
+	u, ok := f.(*FuncU)
+	if !ok {
+		return
+	}
+	u = c.ip.userFunc(u)
+	if c.seen[u] {
+		return
+	}
+	c.seen[u] = true
+	if u.body != nil {
+		c.body(u.name, u.body)
+	}
+}
+
+// 大域の名前の参照
+func (c *pureCheck) global(pos Pos, name Variable) {
+	if _, ok := c.ip.lookUpConst(name); ok {
+		return
+	}
+	if _, ok := c.ip.globalEnv[name]; !ok {
+		if f, ok := c.ip.funcTable[string(name)]; ok {
+			c.call(f)
+			return
+		}
+	}
+	c.fail(pos, "reads", name)
+}
+
+func (c *pureCheck) walk(e Expr) {
+	switch e := e.(type) {
+	case *FuncVal:
+		c.call(e.fn)
+	case Variable:
+		c.global(Pos{}, e)
+	case *VarRef:
+		if !e.local {
+			c.global(e.start, e.name)
+		}
+	case *Agn:
+		if !e.local {
+			c.fail(e.start, "assigns", e.name)
+		}
+		c.walk(e.expr)
+	case *OpAgn:
+		if !e.local {
+			c.fail(e.start, "assigns", e.name)
+		}
+		c.walk(e.expr)
+	case *Op1:
+		c.walk(e.expr)
+	case *Op2:
+		c.walk(e.left)
+		c.walk(e.right)
+	case *Ops:
+		c.walk(e.left)
+		c.walk(e.right)
+	case *Chain:
+		c.walkAll(e.xs)
+	case *Sel:
+		c.walk(e.testForm)
+		c.walk(e.thenForm)
+		c.walk(e.elseForm)
+	case *Bgn:
+		c.walkAll(e.body)
+	case *Whl:
+		c.walk(e.testForm)
+		c.walk(e.body)
+	case *For:
+		c.walk(e.seq)
+		c.walk(e.body)
+	case *Let:
+		c.walkAll(e.vals)
+		c.walk(e.body)
+	case *Lambda:
+		c.walk(e.fn.body)
+	case *Call:
+		c.walk(e.fn)
+		c.walkAll(e.xs)
+	case *App:
+		c.call(e.fn)
+		c.walkAll(e.xs)
+	case *ListExpr:
+		c.walkAll(e.elems)
+	case *MapExpr:
+		c.walkAll(e.keys)
+		c.walkAll(e.vals)
+	case *Index:
+		c.walk(e.expr)
+		c.walk(e.index)
+	case *Slice:
+		c.walk(e.expr)
+		if e.lo != nil {
+			c.walk(e.lo)
+		}
+		if e.hi != nil {
+			c.walk(e.hi)
+		}
+	case *IndexAgn:
+		c.walk(e.target)
+		c.walk(e.expr)
+	}
+}
+
+func (c *pureCheck) walkAll(es []Expr) {
+	for _, e := range es {
+		c.walk(e)
+	}
+}
+
+// 関数を定義したら、覚えておいた結果をすべて捨てる
+// 呼び出す関数を定義し直して大域変数を読み書きするようになった関数は結果を覚えるのをやめる
+func (ip *Interpreter) resetMemo() {
+	for _, f := range ip.funcTable {
+		u, ok := f.(*FuncU)
+		if !ok || u.memo == nil {
+			continue
+		}
+		if ip.checkPure(u, u.body) != nil {
+			u.memo = nil
+			continue
+		}
+		u.memo.clear()
+	}
+}
+
+// 結果を覚える関数を取り出す
+func toMemo(ip *Interpreter, v Value) *memoTable {
+	if f, ok := v.(*FuncVal); ok {
+		if u, ok := f.fn.(*FuncU); ok {
+			if t := ip.userFunc(u).memo; t != nil {
+				return t
+			}
+		}
+		panic(runtimeError(Pos{}, "%v is not memoized", f.name))
+	}
+	panic(runtimeError(Pos{}, "function expected, got %v", v.Type()))
+}
+
+// 覚えておいた結果を調べる組み込み関数
+func initMemoFunc() {
+	builtinTable["memostats"] = FuncV{1, false, func(ip *Interpreter, xs []Value) Value {
+		return toMemo(ip, xs[0]).stats()
+	}}
+	builtinTable["memoclear"] = FuncV{1, false, func(ip *Interpreter, xs []Value) Value {
+		return Num(toMemo(ip, xs[0]).clear())
+	}}
+}
@@ -0,0 +1,250 @@
+package lex
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func memoStats(entries, hits, misses float64) *Map {
+	m := newMap()
+	m.set(Str("entries"), Num(entries))
+	m.set(Str("hits"), Num(hits))
+	m.set(Str("misses"), Num(misses))
+	return m
+}
+
+func TestMemo(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want Value
+	}{
+		{
+			name: "fib",
+			src:  "memo def fib(n) if n < 2 then n else fib(n - 1) + fib(n - 2) end end fib(70)",
+			want: Num(190392490709135),
+		},
+		{
+			name: "stats",
+			src:  "memo def fib(n) if n < 2 then n else fib(n - 1) + fib(n - 2) end end fib(30); memostats(fib)",
+			want: memoStats(31, 28, 31),
+		},
+		{
+			name: "clear",
+			src:  "memo def sq(n) n * n end sq(2) + sq(3) + sq(2); [memoclear(sq), memostats(sq)]",
+			want: newList([]Value{Num(2), memoStats(0, 0, 0)}),
+		},
+		{
+			name: "tail calls",
+			src: "memo def loop(n, acc) if n == 0 then acc else loop(n - 1, acc + n) end end " +
+				"loop(10, 0); [loop(5, 40), memostats(loop)]",
+			want: newList([]Value{Num(55), memoStats(11, 1, 11)}),
+		},
+		{
+			name: "argument types",
+			src:  `memo def id(x) x end [id(0), id(-0), id("0"), id(false), id(nil), 1 / id(-0)]`,
+			want: newList([]Value{Num(0), Num(0), Str("0"), Bool(false), Nil{}, Num(-1 / zero)}),
+		},
+		{
+			name: "list argument is not cached",
+			src:  "memo def size(xs) len(xs) end xs = [1]; size(xs); push(xs, 2); [size(xs), memostats(size)]",
+			want: newList([]Value{Num(2), memoStats(0, 0, 0)}),
+		},
+		{
+			name: "list result is not cached",
+			src:  "memo def pair(n) [n, n] end pair(1)[0] = 5; [pair(1), memostats(pair)]",
+			want: newList([]Value{nums(1, 1), memoStats(0, 0, 2)}),
+		},
+		{
+			name: "locals",
+			src: "memo def f(n) let s = 0 in begin for i in range(n) do s += i * 3 end, s + pi - pi end end end " +
+				"[f(4), f(4), memostats(f)]",
+			want: newList([]Value{Num(18), Num(18), memoStats(1, 1, 1)}),
+		},
+		{
+			name: "declared callee",
+			src: "declare odd(n); memo def even(n) if n == 0 then true else odd(n - 1) end end " +
+				"memo def odd(n) if n == 0 then false else even(n - 1) end end [even(10), odd(7), memostats(odd)]",
+			want: newList([]Value{Bool(true), Bool(true), memoStats(5, 1, 5)}),
+		},
+	}
+	for _, b := range []Backend{TreeWalk, Bytecode} {
+		for _, tt := range tests {
+			t.Run(b.String()+"/"+tt.name, func(t *testing.T) {
+				ip := NewInterpreter()
+				ip.Backend = b
+				e, err := ip.Parse(tt.src)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := ip.Eval(e)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("Eval() = %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+var zero = 0.0
+
+// 大域変数を読み書きする関数は memo def で定義できない
+func TestMemo_Impure(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"assign", "memo def f(n) x = n end", "memo f: f assigns global variable x"},
+		{"compound assign", "x = 0; memo def f(n) x += n end", "memo f: f assigns global variable x"},
+		{"read", "x = 1; memo def f(n) n + x end", "memo f: f reads global variable x"},
+		{"undefined", "memo def f(n) n + y end", "memo f: f reads global variable y"},
+		{"callee", "def g(n) x = n end memo def f(n) g(n) + 1 end", "memo f: g assigns global variable x"},
+		{"function value", "def g(n) x = n end memo def f(n) map([n], g) end", "memo f: g assigns global variable x"},
+		{"lambda", "memo def f(n) fn() x = n end end", "memo f: f assigns global variable x"},
+		{"not def", "memo f(n) n end", "'def' expected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := NewInterpreter()
+			_, err := ip.Parse(tt.src)
+			var se *SyntaxError
+			if !errors.As(err, &se) || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Parse() error = %v, want %q", err, tt.want)
+			}
+			if _, ok := ip.funcTable["f"]; ok {
+				t.Errorf("f is defined")
+			}
+		})
+	}
+}
+
+// 定義し直すと結果を覚えるかどうかも変わる
+func TestMemo_Redefine(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"plain def", "memo def f(n) n end def f(n) n end memostats(f)", "f is not memoized"},
+		{"impure callee", "def g(n) n end memo def f(n) g(n) end def g(n) x = n end memostats(f)", "f is not memoized"},
+		{"builtin", "memostats(sqrt)", "sqrt is not memoized"},
+		{"not a function", "memoclear(1)", "function expected, got number"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := NewInterpreter()
+			e, err := ip.Parse(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ip.Eval(e); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Eval() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// 関数を定義し直すと覚えておいた結果を捨てる
+func TestMemo_Invalidate(t *testing.T) {
+	steps := []struct {
+		src  string
+		want Value
+	}{
+		{"def g(n) n end memo def f(n) g(n) end f(1)", Num(1)},
+		{"[f(1), memostats(f)]", newList([]Value{Num(1), memoStats(1, 1, 1)})},
+		{"def g(n) n * 2 end [f(1), memostats(f)]", newList([]Value{Num(2), memoStats(1, 0, 1)})},
+		{"memo def f(n) g(n) + 1 end [f(1), memostats(f)]", newList([]Value{Num(3), memoStats(1, 0, 1)})},
+		{"def h(n) n end memostats(f)", memoStats(0, 0, 0)},
+	}
+	for _, b := range []Backend{TreeWalk, Bytecode} {
+		ip := NewInterpreter()
+		ip.Backend = b
+		for _, s := range steps {
+			e, err := ip.Parse(s.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := ip.Eval(e); err != nil || !reflect.DeepEqual(got, s.want) {
+				t.Errorf("%v: %v = %v, %v, want %v", b, s.src, got, err, s.want)
+			}
+		}
+	}
+}
+
+// const で定義した定数は読める
+// def は文より先に定義するので、定数は前の入力で定義しておく
+func TestMemo_Const(t *testing.T) {
+	ip := NewInterpreter()
+	for _, src := range []string{"const k = 3", "memo def f(n) n * k end"} {
+		e, err := ip.Parse(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ip.Eval(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e, err := ip.Parse("[f(2), f(2), memostats(f)]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := newList([]Value{Num(6), Num(6), memoStats(1, 1, 1)})
+	if got, err := ip.Eval(e); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Eval() = %v, %v, want %v", got, err, want)
+	}
+}
+
+// 複製したインタプリタは覚えておいた結果を共有しない
+func TestMemo_Clone(t *testing.T) {
+	ip := NewInterpreter()
+	e, err := ip.Parse("memo def sq(n) n * n end sq(3)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ip.Eval(e); err != nil {
+		t.Fatal(err)
+	}
+	c := ip.Clone()
+	for _, tt := range []struct {
+		ip   *Interpreter
+		want *Map
+	}{{ip, memoStats(1, 0, 1)}, {c, memoStats(0, 0, 0)}} {
+		e, err := tt.ip.Parse("memostats(sq)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := tt.ip.Eval(e); err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("memostats(sq) = %v, %v, want %v", got, err, tt.want)
+		}
+	}
+}
+
+// 並行に実行する Program は覚えておいた結果を共有する
+func TestMemo_Program(t *testing.T) {
+	p, err := Compile("memo def fib(n) if n < 2 then n else fib(n - 1) + fib(n - 2) end end fib(k)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			a, b := 0, 1
+			for j := 0; j < k; j++ {
+				a, b = b, a+b
+			}
+			if got, err := p.Run(map[string]float64{"k": float64(k)}); err != nil || got != Num(a) {
+				t.Errorf("Run(k=%d) = %v, %v, want %v", k, got, err, a)
+			}
+		}(i * 10)
+	}
+	wg.Wait()
+}
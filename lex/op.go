@@ -0,0 +1,185 @@
+package lex
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+func init() {
+	initOps()
+}
+
+// 単項演算子の実装
+type Op1Func func(x Value) (Value, error)
+
+// 二項演算子の実装
+type Op2Func func(x, y Value) (Value, error)
+
+type op1Key struct {
+	code rune
+	x    Type
+}
+
+type op2Key struct {
+	code rune
+	x, y Type
+}
+
+// 演算子表
+// 演算子とオペランドの型の組で実装を引く
+var (
+	op1Table = make(map[op1Key]Op1Func)
+	op2Table = make(map[op2Key]Op2Func)
+)
+
+// 単項演算子を定義する
+// 新しい型を追加するときに init から呼ぶ
+func DefineOp1(code rune, x Type, fn Op1Func) {
+	op1Table[op1Key{code, x}] = fn
+}
+
+// 二項演算子を定義する
+// 新しい型を追加するときに init から呼ぶ
+func DefineOp2(code rune, x, y Type, fn Op2Func) {
+	op2Table[op2Key{code, x, y}] = fn
+}
+
+// 単項演算子の適用
+// not はどの型にも使える
+func applyOp1(code rune, x Value) (Value, error) {
+	if fn, ok := op1Table[op1Key{code, x.Type()}]; ok {
+		return fn(x)
+	}
+	if code == NOT {
+		return boolToValue(isFalse(x)), nil
+	}
+	return nil, fmt.Errorf("invalid operation: %v%v", opName(code), x.Type())
+}
+
+// 二項演算子の適用
+// == と != は定義がなければ同じ値かどうかを比べる
+func applyOp2(code rune, x, y Value) (Value, error) {
+	if fn, ok := op2Table[op2Key{code, x.Type(), y.Type()}]; ok {
+		return fn(x, y)
+	}
+	switch code {
+	case EQ:
+		return boolToValue(x == y), nil
+	case NE:
+		return boolToValue(x != y), nil
+	}
+	return nil, fmt.Errorf("invalid operation: %v %v %v", x.Type(), opName(code), y.Type())
+}
+
+// 組み込みの型の演算子
+func initOps() {
+	// 数値 (真偽値は 1 と 0 として計算する)
+	numOps := map[rune]func(x, y float64) Value{
+		'+': func(x, y float64) Value { return Num(x + y) },
+		'-': func(x, y float64) Value { return Num(x - y) },
+		'*': func(x, y float64) Value { return Num(x * y) },
+		'/': func(x, y float64) Value { return Num(x / y) },
+		'^': func(x, y float64) Value { return Num(math.Pow(x, y)) },
+		EQ:  func(x, y float64) Value { return boolToValue(x == y) },
+		NE:  func(x, y float64) Value { return boolToValue(x != y) },
+		LT:  func(x, y float64) Value { return boolToValue(x < y) },
+		GT:  func(x, y float64) Value { return boolToValue(x > y) },
+		LE:  func(x, y float64) Value { return boolToValue(x <= y) },
+		GE:  func(x, y float64) Value { return boolToValue(x >= y) },
+
+		// // と % は小さい方へ丸める (x == (x // y) * y + x % y)
+		IDIV: func(x, y float64) Value { return Num(math.Floor(x / y)) },
+		'%':  func(x, y float64) Value { return Num(floorMod(x, y)) },
+	}
+	numTypes := []Type{NumType, BoolType}
+	for code, f := range numOps {
+		f := f
+		fn := func(x, y Value) (Value, error) {
+			return f(asNum(x), asNum(y)), nil
+		}
+		for _, t1 := range numTypes {
+			for _, t2 := range numTypes {
+				DefineOp2(code, t1, t2, fn)
+			}
+		}
+	}
+	// 整数のビット演算
+	bitOps := map[rune]func(x, y int64) int64{
+		'&': func(x, y int64) int64 { return x & y },
+		'|': func(x, y int64) int64 { return x | y },
+		XOR: func(x, y int64) int64 { return x ^ y },
+		SHL: func(x, y int64) int64 { return x << uint64(y) },
+		SHR: func(x, y int64) int64 { return x >> uint64(y) },
+	}
+	for code, f := range bitOps {
+		code, f := code, f
+		fn := func(x, y Value) (Value, error) {
+			a, err := toBits(code, x)
+			if err != nil {
+				return nil, err
+			}
+			b, err := toBits(code, y)
+			if err != nil {
+				return nil, err
+			}
+			if (code == SHL || code == SHR) && b < 0 {
+				return nil, fmt.Errorf("negative shift count: %v", b)
+			}
+			return Num(f(a, b)), nil
+		}
+		for _, t1 := range numTypes {
+			for _, t2 := range numTypes {
+				DefineOp2(code, t1, t2, fn)
+			}
+		}
+	}
+	for _, t := range numTypes {
+		DefineOp1('~', t, func(x Value) (Value, error) {
+			a, err := toBits('~', x)
+			if err != nil {
+				return nil, err
+			}
+			return Num(^a), nil
+		})
+		DefineOp1('-', t, func(x Value) (Value, error) {
+			return Num(-asNum(x)), nil
+		})
+		DefineOp1('+', t, func(x Value) (Value, error) {
+			return Num(asNum(x)), nil
+		})
+	}
+
+	// 文字列 (連結と辞書順の比較)
+	strOps := map[rune]func(x, y Str) Value{
+		'+': func(x, y Str) Value { return x + y },
+		LT:  func(x, y Str) Value { return boolToValue(x < y) },
+		GT:  func(x, y Str) Value { return boolToValue(x > y) },
+		LE:  func(x, y Str) Value { return boolToValue(x <= y) },
+		GE:  func(x, y Str) Value { return boolToValue(x >= y) },
+	}
+	for code, f := range strOps {
+		f := f
+		DefineOp2(code, StrType, StrType, func(x, y Value) (Value, error) {
+			return f(x.(Str), y.(Str)), nil
+		})
+	}
+}
+
+// 小さい方へ丸めた除算の余り (y と同じ符号になる)
+func floorMod(x, y float64) float64 {
+	m := math.Mod(x, y)
+	if m != 0 && (m < 0) != (y < 0) {
+		m += y
+	}
+	return m
+}
+
+// ビット演算のオペランドを整数にする
+func toBits(code rune, v Value) (int64, error) {
+	x := asNum(v)
+	if x != math.Trunc(x) || x < math.MinInt64 || x >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid operation: %v on non-integer %v", strings.TrimSpace(opName(code)), x)
+	}
+	return int64(x), nil
+}
@@ -0,0 +1,170 @@
+package lex
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// テスト用の型: 2次元ベクトル
+type vec2 struct {
+	x, y float64
+}
+
+const vec2Type Type = "vec2"
+
+func (v *vec2) Eval(ip *Interpreter, env *Env) Value {
+	return v
+}
+
+func (v *vec2) Type() Type {
+	return vec2Type
+}
+
+func (v *vec2) String() string {
+	return fmt.Sprintf("vec2(%v, %v)", v.x, v.y)
+}
+
+func init() {
+	DefineOp2('+', vec2Type, vec2Type, func(x, y Value) (Value, error) {
+		a, b := x.(*vec2), y.(*vec2)
+		return &vec2{a.x + b.x, a.y + b.y}, nil
+	})
+	DefineOp2('*', NumType, vec2Type, func(x, y Value) (Value, error) {
+		k, v := float64(x.(Num)), y.(*vec2)
+		return &vec2{k * v.x, k * v.y}, nil
+	})
+	DefineOp1('-', vec2Type, func(x Value) (Value, error) {
+		v := x.(*vec2)
+		return &vec2{-v.x, -v.y}, nil
+	})
+}
+
+func TestOp2_Eval(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    Expr
+		want    Value
+		wantErr bool
+	}{
+		{
+			name: "number",
+			expr: newOp2('+', Num(1), Num(2)),
+			want: Num(3),
+		},
+		{
+			name: "comparison",
+			expr: newOp2(LT, Num(1), Num(2)),
+			want: Bool(true),
+		},
+		{
+			name: "bool as number",
+			expr: newOp2('+', newOp2(LT, Num(1), Num(2)), Num(1)),
+			want: Num(2),
+		},
+		{
+			name: "bool equals number",
+			expr: newOp2(EQ, Bool(true), Num(1)),
+			want: Bool(true),
+		},
+		{
+			name: "nil equals nil",
+			expr: newOp2(EQ, Nil{}, Nil{}),
+			want: Bool(true),
+		},
+		{
+			name: "user type",
+			expr: newOp2('+', &vec2{1, 2}, newOp2('*', Num(2), &vec2{3, 4})),
+			want: &vec2{7, 10},
+		},
+		{
+			name: "user type unary",
+			expr: newOp1('-', &vec2{1, 2}),
+			want: &vec2{-1, -2},
+		},
+		{
+			name:    "undefined operator",
+			expr:    newOp2('-', &vec2{1, 2}, Num(1)),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewInterpreter().Eval(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Eval() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Eval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_isTrue(t *testing.T) {
+	tests := []struct {
+		name string
+		v    Value
+		want bool
+	}{
+		{"true", Bool(true), true},
+		{"false", Bool(false), false},
+		{"one", Num(1), true},
+		{"zero", Num(0), false},
+		{"string", Str("a"), true},
+		{"empty string", Str(""), false},
+		{"nil", Nil{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTrue(tt.v); got != tt.want {
+				t.Errorf("isTrue() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOperators(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    Value
+		wantErr bool
+	}{
+		{"power is right associative", "2 ^ 3 ^ 2", Num(512), false},
+		{"power binds tighter than unary minus", "-2 ** 2", Num(-4), false},
+		{"negative exponent", "2 ^ -1", Num(0.5), false},
+		{"power before multiplication", "3 * 2 ^ 2", Num(12), false},
+		{"modulo has sign of divisor", "7 % -3", Num(-2), false},
+		{"integer division rounds down", "-7 // 2", Num(-4), false},
+		{"division identity", "10 // 3 * 3 + 10 % 3", Num(10), false},
+		{"and", "6 & 3", Num(2), false},
+		{"or", "6 | 3", Num(7), false},
+		{"xor", "6 xor 3", Num(5), false},
+		{"shift left", "1 << 10", Num(1024), false},
+		{"shift right", "-16 >> 2", Num(-4), false},
+		{"complement", "~0", Num(-1), false},
+		{"shift before and", "1 << 2 & 4", Num(4), false},
+		{"non-integer operand", "1.5 & 1", nil, true},
+		{"negative shift", "1 << -1", nil, true},
+		{"add assign", "x = 1; x += 2", Num(3), false},
+		{"mul assign", "x = 2; x *= 5; x", Num(10), false},
+		{"assign to local", "let y = 1 in y -= 5, y end", Num(-4), false},
+		{"assign to argument", "def f(n) begin n /= 2, n end end f(9)", Num(4.5), false},
+		{"assign to element", "xs = [1, 2]; xs[1] *= 10; xs[1]", Num(20), false},
+		{"assign to field", "m = {\"a\": 1}; m.a += 1; m.a", Num(2), false},
+		{"unbound variable", "z += 1", nil, true},
+		{"assign to constant", "pi += 1", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := evalString(tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("Eval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
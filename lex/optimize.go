@@ -0,0 +1,312 @@
+package lex
+
+import (
+	"math"
+	"reflect"
+)
+
+// 構文木の最適化
+// 定数だけの部分木を畳み込み、値の変わらない恒等式で簡約し、
+// 条件が定数の if と値を使わない begin の式を取り除く。
+// 評価してエラーになる部分木は残すので、エラーとその位置は最適化しないときと同じになる
+// (数える歩数は減る)
+
+// 文の構文木を最適化する
+// NoOptimize なら何もしない
+func (ip *Interpreter) optimize(e Expr) Expr {
+	if ip.NoOptimize {
+		return e
+	}
+	return ip.simplify(e)
+}
+
+func (ip *Interpreter) simplify(e Expr) Expr {
+	switch e := e.(type) {
+	case *VarRef:
+		// 組み込みの定数は大域変数や const で隠せない
+		if v, ok := constTable[e.name]; ok && !e.local {
+			return v
+		}
+	case *Agn:
+		e.expr = ip.simplify(e.expr)
+	case *OpAgn:
+		e.expr = ip.simplify(e.expr)
+	case *Const:
+		e.expr = ip.simplify(e.expr)
+	case *Op1:
+		e.expr = ip.simplify(e.expr)
+		if x, ok := e.expr.(Value); ok && isConst(x) {
+			if v, ok := ip.fold(func() Value { return e.apply(x) }); ok {
+				return v
+			}
+		}
+		// -(-x) は x
+		if x, ok := e.expr.(*Op1); ok && e.code == '-' && x.code == '-' && isNum(x.expr) {
+			return x.expr
+		}
+	case *Op2:
+		e.left, e.right = ip.simplify(e.left), ip.simplify(e.right)
+		x, okx := e.left.(Value)
+		y, oky := e.right.(Value)
+		if okx && oky && isConst(x) && isConst(y) {
+			if v, ok := ip.fold(func() Value { return e.apply(x, y) }); ok {
+				return v
+			}
+		}
+		return e.identity()
+	case *Ops:
+		e.left, e.right = ip.simplify(e.left), ip.simplify(e.right)
+		// 左辺が定数なら右辺を評価するかどうかが決まる
+		if x, ok := e.left.(Value); ok && isConst(x) {
+			if isTrue(x) == (e.code == AND) {
+				return e.right
+			}
+			return x
+		}
+	case *Chain:
+		xs := make([]Value, len(e.xs))
+		for i := range e.xs {
+			e.xs[i] = ip.simplify(e.xs[i])
+			x, ok := e.xs[i].(Value)
+			if !ok || !isConst(x) {
+				xs = nil
+			} else if xs != nil {
+				xs[i] = x
+			}
+		}
+		if xs != nil {
+			if v, ok := ip.fold(func() Value { return e.fold(xs) }); ok {
+				return v
+			}
+		}
+	case *Sel:
+		e.testForm = ip.simplify(e.testForm)
+		e.thenForm = ip.simplify(e.thenForm)
+		e.elseForm = ip.simplify(e.elseForm)
+		if x, ok := e.testForm.(Value); ok && isConst(x) {
+			if isTrue(x) {
+				return e.thenForm
+			}
+			return e.elseForm
+		}
+	case *Bgn:
+		// 最後の式でなく、評価しても何も起こらない式は捨てる
+		body := e.body[:0]
+		for i, x := range e.body {
+			x = ip.simplify(x)
+			if i == len(e.body)-1 || !isPure(x) {
+				body = append(body, x)
+			}
+		}
+		e.body = body
+		switch len(body) {
+		case 0:
+			return Num(0)
+		case 1:
+			return body[0]
+		}
+	case *Whl:
+		e.testForm, e.body = ip.simplify(e.testForm), ip.simplify(e.body)
+	case *For:
+		e.seq, e.body = ip.simplify(e.seq), ip.simplify(e.body)
+	case *Let:
+		for i := range e.vals {
+			e.vals[i] = ip.simplify(e.vals[i])
+		}
+		e.body = ip.simplify(e.body)
+	case *Lambda:
+		e.fn.setBody(ip.simplify(e.fn.body))
+	case *Call:
+		e.fn = ip.simplify(e.fn)
+		ip.simplifyAll(e.xs)
+	case *App:
+		if xs, ok := ip.simplifyAll(e.xs); ok && isPureFunc(e.fn) {
+			if v, ok := ip.fold(func() Value { return ip.callBuiltin(e.fn, xs) }); ok {
+				return v
+			}
+		}
+	case *ListExpr:
+		ip.simplifyAll(e.elems)
+	case *MapExpr:
+		ip.simplifyAll(e.keys)
+		ip.simplifyAll(e.vals)
+	case *Index:
+		e.expr, e.index = ip.simplify(e.expr), ip.simplify(e.index)
+		x, okx := e.expr.(Value)
+		i, oki := e.index.(Value)
+		if okx && oki && isConst(x) && isConst(i) {
+			if v, ok := ip.fold(func() Value { return e.get(x, i) }); ok {
+				return v
+			}
+		}
+	case *Slice:
+		e.expr = ip.simplify(e.expr)
+		if e.lo != nil {
+			e.lo = ip.simplify(e.lo)
+		}
+		if e.hi != nil {
+			e.hi = ip.simplify(e.hi)
+		}
+	case *IndexAgn:
+		// 代入先は Index のまま残す
+		e.target.expr = ip.simplify(e.target.expr)
+		e.target.index = ip.simplify(e.target.index)
+		e.expr = ip.simplify(e.expr)
+	}
+	return e
+}
+
+// es を最適化する
+// すべて定数ならその値も返す
+func (ip *Interpreter) simplifyAll(es []Expr) ([]Value, bool) {
+	xs := make([]Value, len(es))
+	ok := true
+	for i := range es {
+		es[i] = ip.simplify(es[i])
+		x, isValue := es[i].(Value)
+		if !isValue || !isConst(x) {
+			ok = false
+		}
+		xs[i] = x
+	}
+	return xs, ok
+}
+
+// 値の変わらない恒等式 (x * 1, 1 * x, x / 1, x ^ 1, x - 0)
+// x が数のときだけ使う (真偽値や新しい型では演算子の結果が x と同じとは限らない)。
+// x + 0 は -0 + 0 が 0 になるので簡約しない
+func (e *Op2) identity() Expr {
+	switch {
+	case e.code == '*' && isNumConst(e.right, 1) && isNum(e.left):
+		return e.left
+	case e.code == '*' && isNumConst(e.left, 1) && isNum(e.right):
+		return e.right
+	case (e.code == '/' || e.code == '^') && isNumConst(e.right, 1) && isNum(e.left):
+		return e.left
+	case e.code == '-' && isNumConst(e.right, 0) && !math.Signbit(float64(e.right.(Num))) && isNum(e.left):
+		return e.left
+	}
+	return e
+}
+
+// 比較の連鎖を定数 xs で計算する
+func (e *Chain) fold(xs []Value) Value {
+	var v Value
+	for i := range e.codes {
+		v = e.compare(i, xs[i], xs[i+1])
+		if !isTrue(v) {
+			break
+		}
+	}
+	return v
+}
+
+// 畳み込みで計算してよい歩数
+// 構文解析では Limits の時間や中断が効かないので、長くかかる計算は評価するときに回す
+const foldSteps = 1000
+
+// f を計算する
+// エラーになるか、foldSteps 歩を超えるか、値が畳み込める定数でなければ ok は false
+func (ip *Interpreter) fold(f func() Value) (v Value, ok bool) {
+	steps, limits := ip.steps, ip.Limits
+	ip.steps, ip.Limits.MaxSteps = 0, foldSteps
+	defer func() {
+		ip.steps, ip.Limits = steps, limits
+		if r := recover(); r != nil {
+			v, ok = nil, false
+		}
+	}()
+	v = f()
+	return v, isConst(v)
+}
+
+// 構文木に埋め込んでよい値 (変更できない値)
+// リストや連想配列は評価するたびに新しく作るので畳み込まない
+func isConst(v Value) bool {
+	switch v.(type) {
+	case Num, Str, Bool, Nil:
+		return true
+	}
+	return false
+}
+
+func isNumConst(e Expr, n Num) bool {
+	x, ok := e.(Num)
+	return ok && x == n
+}
+
+// 評価すると数になる (またはエラーになる) 式か
+func isNum(e Expr) bool {
+	switch e := e.(type) {
+	case Num:
+		return true
+	case *Op1:
+		return (e.code == '-' || e.code == '~') && isNum(e.expr)
+	case *Op2:
+		switch e.code {
+		case '+', '-', '*', '/', '%', '^', IDIV, '&', '|', XOR, SHL, SHR:
+			return isNum(e.left) && isNum(e.right)
+		}
+	case *App:
+		switch e.fn.(type) {
+		case Func0, Func1, Func2:
+			return true
+		}
+	}
+	return false
+}
+
+// 評価しても何も起こらない式か
+// 大域変数の参照は未定義のエラーになることがあるので含めない
+func isPure(e Expr) bool {
+	switch e := e.(type) {
+	case Value:
+		return true
+	case *VarRef:
+		return e.local
+	case *Lambda:
+		return true
+	}
+	return false
+}
+
+// 引数が定数なら呼び出しを畳み込める組み込み関数
+// 関数の実体で見分けるので、Register で同じ名前に登録した関数は含まない
+var pureFuncs = make(map[uintptr]bool)
+
+// 副作用があるか、関数を呼び出す組み込み関数
+var impureFuncs = []string{"push", "delete", "map", "filter", "reduce", "integrate", "memostats", "memoclear"}
+
+// 結果がリストになる (畳み込めない) か、引数によって時間のかかる組み込み関数
+// 構文解析のときには計算しない
+var slowFuncs = []string{"range", "keys", "values", "split", "jn", "yn"}
+
+func initPureFuncs() {
+	pureFuncs = make(map[uintptr]bool)
+	for _, f := range builtinTable {
+		pureFuncs[funcPointer(f)] = true
+	}
+	// 実体を共有していても畳み込まない
+	for _, name := range impureFuncs {
+		delete(pureFuncs, funcPointer(builtinTable[name]))
+	}
+	for _, name := range slowFuncs {
+		delete(pureFuncs, funcPointer(builtinTable[name]))
+	}
+}
+
+func isPureFunc(f Func) bool {
+	p := funcPointer(f)
+	return p != 0 && pureFuncs[p]
+}
+
+// 関数の実体のアドレス
+func funcPointer(f Func) uintptr {
+	switch f := f.(type) {
+	case Func0, Func1, Func2:
+		return reflect.ValueOf(f).Pointer()
+	case FuncV:
+		return reflect.ValueOf(f.fn).Pointer()
+	}
+	return 0
+}
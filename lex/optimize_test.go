@@ -0,0 +1,172 @@
+package lex
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want interface{} // 畳み込んだ値か、残った節の型名
+	}{
+		{"arithmetic", "2*3 + 4", Num(10)},
+		{"pure builtin", "sqrt(16) + abs(-2)", Num(6)},
+		{"variadic builtin", "max(1, 5, 3)", Num(5)},
+		{"string", `"ab" + upper("c")`, Str("abC")},
+		{"string index", `"abc"[1]`, Str("b")},
+		{"constant", "pi * 2", Num(2 * math.Pi)},
+		{"chain", "1 < 2 < 3", Bool(true)},
+		{"if true", "if 1 < 2 then 5 else x end", Num(5)},
+		{"if false", "if 1 > 2 then x else 5 end", Num(5)},
+		{"and false", "0 and x", Num(0)},
+		{"and true", "1 and x", "*lex.VarRef"},
+		{"or true", "2 or x", Num(2)},
+		{"dead expressions", "begin 1, fn() 0 end, 2, x end", "*lex.VarRef"},
+		{"global reference is kept", "begin x, 2 end", "*lex.Bgn"},
+		{"times one", "sqrt(x) * 1", "*lex.App"},
+		{"one times", "1 * -sqrt(x)", "*lex.Op1"},
+		{"divide by one", "(x ^ 2) / 1", "*lex.Op2"},
+		{"minus zero", "sqrt(x) - 0", "*lex.App"},
+		{"double negation", "-(-sqrt(x))", "*lex.App"},
+		{"unknown type", "x * 1", "*lex.Op2"},
+		{"bool", "true * 1", Num(1)},
+		{"plus zero", "sqrt(x) + 0", "*lex.Op2"},
+		{"error is kept", `1 + "a"`, "*lex.Op2"},
+		{"list is not folded", "[1, 2]", "*lex.ListExpr"},
+		{"impure builtin", "push([], 1)", "*lex.App"},
+		{"list builder", "len(range(3e7))", "*lex.App"},
+		{"slow builtin", "jn(1e9, 1)", "*lex.App"},
+		{"local variable", "let x = 2 * 3 in x * 1 end", "*lex.Let"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseStatement(t, NewInterpreter(), tt.src)
+			if name, ok := tt.want.(string); ok {
+				if typ := fmt.Sprintf("%T", got); typ != name {
+					t.Errorf("optimize(%v) = %v (%v), want %v", tt.src, got, typ, name)
+				}
+			} else if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("optimize(%v) = %v, want %v", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+// 1つの文を構文解析して最適化した構文木 (文が1つなら Parse はその構文木を返す)
+func parseStatement(t *testing.T, ip *Interpreter, src string) Expr {
+	t.Helper()
+	e, err := ip.Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// 関数の本体も最適化する
+func TestOptimize_Body(t *testing.T) {
+	ip := NewInterpreter()
+	if _, err := ip.Parse("def f(x) if 0 then x else x * (2 + 3) end end"); err != nil {
+		t.Fatal(err)
+	}
+	body := ip.funcTable["f"].(*FuncU).body
+	if op, ok := body.(*Op2); !ok || op.right != Num(5) {
+		t.Errorf("body of f = %#v", body)
+	}
+	lambda := parseStatement(t, ip, "fn(x) begin 1, x + 2 * 3 end end").(*Lambda)
+	if op, ok := lambda.fn.body.(*Op2); !ok || op.right != Num(6) {
+		t.Errorf("body of lambda = %#v", lambda.fn.body)
+	}
+}
+
+// 畳み込みは foldSteps 歩までで、評価の歩数と上限は変えない
+func TestInterpreter_fold(t *testing.T) {
+	ip := NewInterpreter()
+	ip.steps, ip.Limits.MaxSteps = 5, 10
+	ticks := func(n int) func() Value {
+		return func() Value {
+			for i := 0; i < n; i++ {
+				ip.tick(Pos{})
+			}
+			return Num(n)
+		}
+	}
+	if v, ok := ip.fold(ticks(foldSteps)); !ok || v != Num(foldSteps) {
+		t.Errorf("fold(%d steps) = %v, %v", foldSteps, v, ok)
+	}
+	if v, ok := ip.fold(ticks(foldSteps + 1)); ok {
+		t.Errorf("fold(%d steps) = %v, want not folded", foldSteps+1, v)
+	}
+	if ip.steps != 5 || ip.Limits.MaxSteps != 10 {
+		t.Errorf("steps = %v, MaxSteps = %v, want 5, 10", ip.steps, ip.Limits.MaxSteps)
+	}
+}
+
+func TestInterpreter_NoOptimize(t *testing.T) {
+	ip := NewInterpreter()
+	ip.NoOptimize = true
+	if got := parseStatement(t, ip, "2 * 3"); fmt.Sprintf("%T", got) != "*lex.Op2" {
+		t.Errorf("NoOptimize: got %#v", got)
+	}
+	if got := parseStatement(t, ip.Clone(), "2 * 3"); fmt.Sprintf("%T", got) != "*lex.Op2" {
+		t.Errorf("Clone does not keep NoOptimize: got %#v", got)
+	}
+}
+
+// Register で置き換えた関数は畳み込まない
+func TestOptimize_Registered(t *testing.T) {
+	ip := NewInterpreter()
+	if err := ip.Register("sqrt", func(x float64) float64 { return x + 1 }); err != nil {
+		t.Fatal(err)
+	}
+	e := parseStatement(t, ip, "sqrt(4)")
+	if fmt.Sprintf("%T", e) != "*lex.App" {
+		t.Errorf("registered function is folded: %#v", e)
+	}
+	if got, err := ip.Eval(e); err != nil || got != Num(5) {
+		t.Errorf("Eval() = %v, %v, want 5", got, err)
+	}
+}
+
+// 最適化してもしなくても値とエラーは同じになる
+func TestOptimize_Same(t *testing.T) {
+	srcs := []string{
+		"2 * 3 + x * 1 + 0",
+		"x = -0; [x + 0, x - 0, x * 1, 1 / (x - 0)]",
+		"x = true; [x * 1, x / 1, x - 0, x ^ 1]",
+		`x = "a"; x * 1`,
+		"if sqrt(4) == 2 then 1 else y end",
+		"begin 1, 2, z end",
+		"begin z, 2 end",
+		"def f(n) if n < 2 then n * 1 else f(n - 1) + f(n - 2) end end f(10)",
+		`1 + "a"`,
+		`"abc"[5]`,
+		"sqrt(\"a\")",
+		"1 < 2 < \"a\"",
+		"let a = 2 * 3, b = a * 1 in -(-a) - 0 + b end",
+		"0 and y",
+		"1 or y",
+		"xs = [1 + 1]; xs[0] = 3; [xs, [1 + 1]]",
+	}
+	for _, src := range srcs {
+		t.Run(src, func(t *testing.T) {
+			var results [2]string
+			for i, noopt := range []bool{false, true} {
+				ip := NewInterpreter()
+				ip.NoOptimize = noopt
+				e, err := ip.Parse(src)
+				if err != nil {
+					t.Fatal(err)
+				}
+				v, err := ip.Eval(e)
+				results[i] = fmt.Sprintf("%v %v", v, err)
+			}
+			if results[0] != results[1] {
+				t.Errorf("optimized: %v\nnot optimized: %v", results[0], results[1])
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package lex
+
+// 使える言語機能の制限
+// 構文解析のときに調べ、許されない構文は *PolicyError にする。
+// ゼロ値はすべてを許す
+type Policy struct {
+	NoDef          bool     // def, declare, infix を禁止する
+	NoGlobalAssign bool     // 大域変数への代入を禁止する (局所変数への代入は許す)
+	NoWhile        bool     // while を禁止する
+	Funcs          []string // 使える関数の名前 (nil なら関数表のすべて)
+}
+
+// 関数を使ってよいか
+func (p *Policy) allowFunc(name string) bool {
+	if p.Funcs == nil {
+		return true
+	}
+	for _, f := range p.Funcs {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 構文が許されていなければ pos の位置でエラーにする
+func checkPolicy(pos Pos, denied bool, what string) {
+	if denied {
+		panic(&PolicyError{pos, what})
+	}
+}
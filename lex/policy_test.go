@@ -0,0 +1,121 @@
+package lex
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	formula := Policy{
+		NoDef:          true,
+		NoGlobalAssign: true,
+		NoWhile:        true,
+		Funcs:          []string{"sqrt", "max", "map"},
+	}
+	tests := []struct {
+		name   string
+		policy Policy
+		src    string
+		want   Value
+		denied bool
+	}{
+		{
+			name:   "formula",
+			policy: formula,
+			src:    "sqrt(x * x + 16) + max([1, 2])",
+			want:   Num(7),
+		},
+		{
+			name:   "def",
+			policy: formula,
+			src:    "def f(x) x end 0",
+			denied: true,
+		},
+		{
+			name:   "declare",
+			policy: formula,
+			src:    "declare f(x); 0",
+			denied: true,
+		},
+		{
+			name:   "global assignment",
+			policy: formula,
+			src:    "y = 1",
+			denied: true,
+		},
+		{
+			name:   "global assignment in lambda",
+			policy: formula,
+			src:    "map(fn(a) y = a end, [1])",
+			denied: true,
+		},
+		{
+			name:   "local assignment",
+			policy: formula,
+			src:    "let a = 1, b = a + 1 in a = a + b, for i in [1, 2] do a = a + i end, a end",
+			want:   Num(6),
+		},
+		{
+			name:   "parameter assignment",
+			policy: formula,
+			src:    "map(fn(a) a = a * 2 end, [1, 2])",
+			want:   nums(2, 4),
+		},
+		{
+			name:   "local out of scope",
+			policy: formula,
+			src:    "let a = 1 in a end + (a = 2)",
+			denied: true,
+		},
+		{
+			name:   "while",
+			policy: formula,
+			src:    "while false do 0 end",
+			denied: true,
+		},
+		{
+			name:   "function not in list",
+			policy: formula,
+			src:    "sin(0)",
+			denied: true,
+		},
+		{
+			name:   "function value not in list",
+			policy: formula,
+			src:    "map(sin, [0])",
+			denied: true,
+		},
+		{
+			name:   "default allows everything",
+			policy: Policy{},
+			src:    "def f(x) x end y = 0; while y < 3 do y = y + 1 end; f(sin(0) + y)",
+			want:   Num(3),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := NewInterpreter()
+			ip.globalEnv["x"] = Num(3)
+			ip.Policy = tt.policy
+			e, err := ip.Parse(tt.src)
+			var pe *PolicyError
+			if tt.denied {
+				if !errors.As(err, &pe) {
+					t.Fatalf("Parse() error = %v, want PolicyError", err)
+				}
+				if !pe.Pos.IsValid() {
+					t.Errorf("PolicyError has no position")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ip.Eval(e)
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Eval() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package lex
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"text/scanner"
+)
+
+// 読み込んだソースの最近の部分を保持する
+// エラー表示で該当行を取り出すのに使う
+type source struct {
+	r    io.Reader
+	buf  []byte
+	base int // buf の先頭の入力の中での位置
+}
+
+// 文を読み始める位置より前に残しておく行数
+// 少し前に定義した関数の中のエラーも該当行を表示できるようにする
+const sourceKeepLines = 16
+
+func (s *source) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.buf = append(s.buf, p[:n]...)
+	return n, err
+}
+
+// offset を含む行の sourceKeepLines 行前より前を捨てる
+// 対話モードやスクリプトは入力がいくらでも続くので、文を読み始めるたびに呼ぶ
+func (s *source) forget(offset int) {
+	i := offset - s.base
+	if i <= 0 || i > len(s.buf) {
+		return
+	}
+	start := bytes.LastIndexByte(s.buf[:i], '\n') + 1
+	for n := 0; n < sourceKeepLines && start > 0; n++ {
+		start = bytes.LastIndexByte(s.buf[:start-1], '\n') + 1
+	}
+	if start == 0 {
+		return
+	}
+	s.buf = s.buf[:copy(s.buf, s.buf[start:])]
+	s.base += start
+}
+
+// offset を含む行を返す
+// 捨てた部分の行は返せない
+func (s *source) line(offset int) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	offset -= s.base
+	if offset < 0 || offset > len(s.buf) {
+		return "", false
+	}
+	start := bytes.LastIndexByte(s.buf[:offset], '\n') + 1
+	end := bytes.IndexByte(s.buf[offset:], '\n')
+	if end < 0 {
+		end = len(s.buf)
+	} else {
+		end += offset
+	}
+	return string(s.buf[start:end]), true
+}
+
+// ソース上の位置
+type Pos struct {
+	scanner.Position
+	src *source
+}
+
+// 位置のある行とその下にキャレットを付けた文字列を返す
+func (p Pos) caret() (string, bool) {
+	if !p.IsValid() {
+		return "", false
+	}
+	line, ok := p.src.line(p.Offset)
+	if !ok {
+		return "", false
+	}
+	var b strings.Builder
+	b.WriteString(line)
+	b.WriteByte('\n')
+	// タブはそのまま残して桁を合わせる
+	for i, c := range []rune(line) {
+		if i >= p.Column-1 {
+			break
+		}
+		if c == '\t' {
+			b.WriteByte('\t')
+		} else {
+			b.WriteByte(' ')
+		}
+	}
+	b.WriteByte('^')
+	return b.String(), true
+}
+
+// 構文木のソース上の範囲
+type span struct {
+	start, end Pos
+}
+
+// 構文木の開始位置と終了位置
+func (s *span) Span() (start, end Pos) {
+	return s.start, s.end
+}
+
+func (s *span) setSpan(start, end Pos) {
+	s.start = start
+	s.end = end
+}
+
+// 位置を持つ構文木
+type Node interface {
+	Expr
+	Span() (start, end Pos)
+}
+
+// 位置を持つエラー
+type positioner interface {
+	Position() Pos
+}
+
+// 位置を付けたエラーメッセージ
+func posMessage(p Pos, msg string) string {
+	if !p.IsValid() {
+		return msg
+	}
+	return p.String() + ": " + msg
+}
@@ -0,0 +1,85 @@
+package lex
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestFormatError(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "syntax error",
+			src:  "1 +\n  (2 * 3;",
+			want: "<input>:2:9: ')' expected\n  (2 * 3;\n        ^",
+		},
+		{
+			name: "unbound variable in def body",
+			src:  "def f(x)\n\tx + y\nend\nf(1);",
+			want: "<input>:2:6: unbound variable: y\n\tx + y\n\t    ^",
+		},
+		{
+			name: "arity",
+			src:  "a = 1;\nb = atan2(a);",
+			want: "<input>:2:5: wrong number of arguments: atan2 (want 2, got 1)\nb = atan2(a);\n    ^",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := NewInterpreter()
+			e, err := ip.Parse(tt.src)
+			if err == nil {
+				_, err = ip.Eval(e)
+			}
+			if err == nil {
+				t.Fatalf("no error")
+			}
+			if got := FormatError(err); got != tt.want {
+				t.Errorf("FormatError() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// 長い入力でも最近の行だけを残し、エラーの該当行は表示できる
+func TestSource_forget(t *testing.T) {
+	src := strings.Repeat("1;\n", 100000) + "def f(x)\n\tx + y\nend\nf(1);\n"
+	var out strings.Builder
+	ip := NewInterpreter()
+	ip.Stdout = &out
+	var lex Lex
+	lex.Init(strings.NewReader(src))
+	lex.Filename = "<input>"
+	lex.ip = ip
+	var err error
+	for err == nil {
+		err = ip.topLevel1(context.Background(), &lex)
+	}
+	want := "<input>:100002:6: unbound variable: y\n\tx + y\n\t    ^"
+	if got := FormatError(err); got != want {
+		t.Errorf("FormatError() = %q, want %q", got, want)
+	}
+	if n := len(lex.src.buf); n > 4096 {
+		t.Errorf("len(buf) = %v, want the recent lines only", n)
+	}
+}
+
+func TestLex_mark(t *testing.T) {
+	ip := NewInterpreter()
+	e, err := ip.Parse("x = 1;\n  x * (2 + 3)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, ok := e.(*Bgn).body[1].(Node)
+	if !ok {
+		t.Fatalf("%T has no span", e)
+	}
+	start, end := n.Span()
+	if start.Line != 2 || start.Column != 3 || end.Line != 2 || end.Column != 14 {
+		t.Errorf("Span() = %v - %v, want 2:3 - 2:14", start, end)
+	}
+}
@@ -0,0 +1,260 @@
+package lex
+
+import (
+	"context"
+	"sort"
+)
+
+// 一度構文解析して何度も評価する式
+// 構文木と関数表は作ったあと変更しないので、複数のゴルーチンから同時に Run してよい
+type Program struct {
+	expr     Expr
+	funcs    map[string]Func    // 関数表の写し (読み出し専用)
+	consts   map[Variable]Value // 定数表の写し (読み出し専用)
+	limits   Limits
+	policy   Policy
+	maxDepth int
+	backend  Backend
+	free     []string
+}
+
+// 変数の値を与えるもの
+// 局所変数にも大域変数にもない変数を評価するときに呼ばれる
+type Resolver interface {
+	Resolve(name string) (Value, bool)
+}
+
+// 名前と数値の表で変数の値を与える
+type Vars map[string]float64
+
+func (vs Vars) Resolve(name string) (Value, bool) {
+	x, ok := vs[name]
+	return Num(x), ok
+}
+
+// 関数で変数の値を与える
+type ResolverFunc func(name string) (Value, bool)
+
+func (f ResolverFunc) Resolve(name string) (Value, bool) {
+	return f(name)
+}
+
+// 組み込み関数だけを使って src を構文解析する
+func Compile(src string) (*Program, error) {
+	return NewInterpreter().Compile(src)
+}
+
+// インタプリタの関数表・上限・制限を使って src を構文解析する
+// src の中の def はインタプリタには登録しない
+// 大域変数は引き継がないので、Run に渡す変数で与えること
+func (ip *Interpreter) Compile(src string) (*Program, error) {
+	c := ip.Clone()
+	e, err := c.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &Program{
+		expr:     e,
+		funcs:    c.funcTable,
+		consts:   c.consts,
+		limits:   c.Limits,
+		policy:   c.Policy,
+		maxDepth: c.MaxDepth,
+		backend:  c.Backend,
+		free:     freeVars(c, e),
+	}
+	if p.backend == Bytecode {
+		if c := compile(e); c != nil {
+			p.expr = c
+		}
+	}
+	return p, nil
+}
+
+// 変数の値を vars で与えて評価する
+func (p *Program) Run(vars map[string]float64) (Value, error) {
+	return p.RunContext(context.Background(), Vars(vars))
+}
+
+// 変数の値を r で与えて評価する
+// 式の中で代入した大域変数はこの評価の中だけで使える
+func (p *Program) RunContext(ctx context.Context, r Resolver) (v Value, err error) {
+	ip := &Interpreter{
+		globalEnv: make(map[Variable]Value),
+		funcTable: p.funcs,
+		consts:    p.consts,
+		constRO:   true,
+		Limits:    p.limits,
+		Policy:    p.policy,
+		MaxDepth:  p.maxDepth,
+		Backend:   p.backend,
+		vars:      r,
+	}
+	defer catch(&err)
+	return ip.evalIn(ctx, p.expr), nil
+}
+
+// 式が参照する自由変数の名前 (Run で値を与える変数)
+// 局所変数・関数名と、参照するより前に式の中で代入した大域変数は含まない
+func (p *Program) FreeVars() []string {
+	xs := make([]string, len(p.free))
+	copy(xs, p.free)
+	return xs
+}
+
+// 自由変数を集める
+// 呼び出すユーザ定義関数の本体も調べる
+func freeVars(ip *Interpreter, e Expr) []string {
+	w := &freeWalker{
+		ip:      ip,
+		defined: make(map[Variable]bool),
+		seen:    make(map[Variable]bool),
+		funcs:   make(map[*FuncU]bool),
+		free:    make([]string, 0),
+	}
+	w.walk(e, nil)
+	sort.Strings(w.free)
+	return w.free
+}
+
+type freeWalker struct {
+	ip      *Interpreter
+	defined map[Variable]bool // 代入した大域変数
+	seen    map[Variable]bool // 自由変数として記録したもの
+	funcs   map[*FuncU]bool   // 調べたユーザ定義関数
+	free    []string
+}
+
+// locals はその位置で見える局所変数
+func (w *freeWalker) walk(e Expr, locals []Variable) {
+	switch e := e.(type) {
+	case Variable:
+		w.ref(e, locals)
+	case *VarRef:
+		w.ref(e.name, locals)
+	case *FuncVal:
+		if f, ok := e.fn.(*FuncU); ok {
+			w.walkFunc(f)
+		}
+	case *Agn:
+		w.walk(e.expr, locals)
+		if !hasVar(locals, e.name) {
+			w.defined[e.name] = true
+		}
+	case *OpAgn:
+		w.ref(e.name, locals)
+		w.walk(e.expr, locals)
+	case *Const:
+		w.walk(e.expr, locals)
+		w.defined[e.name] = true
+	case *Op1:
+		w.walk(e.expr, locals)
+	case *Op2:
+		w.walk(e.left, locals)
+		w.walk(e.right, locals)
+	case *Ops:
+		w.walk(e.left, locals)
+		w.walk(e.right, locals)
+	case *Chain:
+		for _, x := range e.xs {
+			w.walk(x, locals)
+		}
+	case *Sel:
+		w.walk(e.testForm, locals)
+		w.walk(e.thenForm, locals)
+		w.walk(e.elseForm, locals)
+	case *Bgn:
+		for _, x := range e.body {
+			w.walk(x, locals)
+		}
+	case *Whl:
+		w.walk(e.testForm, locals)
+		w.walk(e.body, locals)
+	case *For:
+		w.walk(e.seq, locals)
+		w.walk(e.body, withVars(locals, e.name))
+	case *Let:
+		for i, x := range e.vals {
+			w.walk(x, locals)
+			locals = withVars(locals, e.vars[i])
+		}
+		w.walk(e.body, locals)
+	case *Lambda:
+		w.walk(e.fn.body, withVars(locals, e.fn.xs...))
+	case *Call:
+		w.walk(e.fn, locals)
+		for _, x := range e.xs {
+			w.walk(x, locals)
+		}
+	case *App:
+		for _, x := range e.xs {
+			w.walk(x, locals)
+		}
+		if f, ok := e.fn.(*FuncU); ok {
+			w.walkFunc(w.ip.userFunc(f))
+		}
+	case *ListExpr:
+		for _, x := range e.elems {
+			w.walk(x, locals)
+		}
+	case *MapExpr:
+		for i := range e.keys {
+			w.walk(e.keys[i], locals)
+			w.walk(e.vals[i], locals)
+		}
+	case *Index:
+		w.walk(e.expr, locals)
+		w.walk(e.index, locals)
+	case *Slice:
+		w.walk(e.expr, locals)
+		if e.lo != nil {
+			w.walk(e.lo, locals)
+		}
+		if e.hi != nil {
+			w.walk(e.hi, locals)
+		}
+	case *IndexAgn:
+		w.walk(e.target, locals)
+		w.walk(e.expr, locals)
+	}
+}
+
+func (w *freeWalker) walkFunc(f *FuncU) {
+	if w.funcs[f] || f.body == nil {
+		return
+	}
+	w.funcs[f] = true
+	w.walk(f.body, f.xs)
+}
+
+func (w *freeWalker) ref(name Variable, locals []Variable) {
+	if hasVar(locals, name) || w.defined[name] || w.seen[name] {
+		return
+	}
+	if _, ok := w.ip.lookUpConst(name); ok {
+		return
+	}
+	// 関数名は関数値になる
+	if f, ok := w.ip.funcTable[string(name)]; ok {
+		if u, ok := f.(*FuncU); ok {
+			w.walkFunc(u)
+		}
+		return
+	}
+	w.seen[name] = true
+	w.free = append(w.free, string(name))
+}
+
+func hasVar(xs []Variable, name Variable) bool {
+	for _, x := range xs {
+		if x == name {
+			return true
+		}
+	}
+	return false
+}
+
+// xs に vs を加えた局所変数の並び (xs は変更しない)
+func withVars(xs []Variable, vs ...Variable) []Variable {
+	return append(xs[:len(xs):len(xs)], vs...)
+}
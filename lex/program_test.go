@@ -0,0 +1,207 @@
+package lex
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestProgram_Run(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		vars    map[string]float64
+		want    Value
+		wantErr bool
+	}{
+		{
+			name: "formula",
+			src:  "price * qty * (1 - discount)",
+			vars: map[string]float64{"price": 100, "qty": 3, "discount": 0.5},
+			want: Num(150),
+		},
+		{
+			name: "function",
+			src:  "def sq(x) x * x end sq(a) + sq(b)",
+			vars: map[string]float64{"a": 3, "b": 4},
+			want: Num(25),
+		},
+		{
+			name: "local shadows var",
+			src:  "let a = 10 in a + b end",
+			vars: map[string]float64{"a": 1, "b": 2},
+			want: Num(12),
+		},
+		{
+			name: "assignment",
+			src:  "t = a * 2; t + 1",
+			vars: map[string]float64{"a": 3},
+			want: Num(7),
+		},
+		{
+			name:    "missing variable",
+			src:     "a + b",
+			vars:    map[string]float64{"a": 1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Compile(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.Run(tt.vars)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("Run() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 評価ごとに大域変数は別になり、作ったインタプリタにも影響しない
+func TestProgram_Isolation(t *testing.T) {
+	ip := NewInterpreter()
+	run(ip, "def f(x) x + 1 end quit")
+	p, err := ip.Compile("def g(x) f(x) * 2 end n = g(a); n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if got, err := p.Run(map[string]float64{"a": 1}); err != nil || got != Num(4) {
+			t.Errorf("Run() = %v, %v, want 4", got, err)
+		}
+	}
+	if _, ok := ip.funcTable["g"]; ok {
+		t.Errorf("Compile() defined g in the interpreter")
+	}
+	if _, ok := ip.globalEnv["n"]; ok {
+		t.Errorf("Run() assigned n in the interpreter")
+	}
+}
+
+func TestProgram_Concurrent(t *testing.T) {
+	p, err := Compile("def f(n) if n <= 1 then n else f(n - 1) + f(n - 2) end end s = 0; " +
+		"for i in range(k) do s = s + i end; s + f(10)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			want := Num(k*(k-1)/2 + 55)
+			if got, err := p.Run(map[string]float64{"k": float64(k)}); err != nil || got != want {
+				t.Errorf("Run(k=%d) = %v, %v, want %v", k, got, err, want)
+			}
+		}(i * 10)
+	}
+	wg.Wait()
+}
+
+func TestProgram_RunContext(t *testing.T) {
+	p, err := Compile(`name + ": " + str(len(tags))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := ResolverFunc(func(name string) (Value, bool) {
+		switch name {
+		case "name":
+			return Str("x"), true
+		case "tags":
+			return nums(1, 2), true
+		}
+		return nil, false
+	})
+	if got, err := p.RunContext(context.Background(), r); err != nil || got != Str("x: 2") {
+		t.Errorf("RunContext() = %v, %v", got, err)
+	}
+}
+
+func TestProgram_Limits(t *testing.T) {
+	ip := NewInterpreter()
+	ip.Limits.MaxSteps = 100
+	p, err := ip.Compile("while 1 do 0 end")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var le *LimitError
+	if _, err := p.Run(nil); !errors.As(err, &le) {
+		t.Errorf("Run() error = %v, want LimitError", err)
+	}
+}
+
+// 評価するときに探す関数名にも Policy を使う
+func TestProgram_Policy(t *testing.T) {
+	ip := NewInterpreter()
+	ip.Policy = Policy{Funcs: []string{"f"}}
+	p, err := ip.Compile("def f() g end def g() 1 end f()()")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ue *UnboundVariableError
+	if _, err := p.Run(nil); !errors.As(err, &ue) {
+		t.Errorf("Run() error = %v, want UnboundVariableError", err)
+	}
+}
+
+func TestProgram_FreeVars(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{
+			name: "formula",
+			src:  "price * qty + sqrt(b) + price",
+			want: []string{"b", "price", "qty"},
+		},
+		{
+			name: "locals",
+			src:  "let a = x in for i in xs do a = a + i end, fn(y) y + z end end",
+			want: []string{"x", "xs", "z"},
+		},
+		{
+			name: "assigned before use",
+			src:  "a = 1; b = b + a; a + c",
+			want: []string{"b", "c"},
+		},
+		{
+			name: "function body",
+			src:  "def f(x) x * rate end def g(x) f(x) + h(x) end g(1)",
+			want: []string{"h", "rate"},
+		},
+		{
+			name: "index and slice",
+			src:  `m.k + xs[i:j] + {"a": v}["a"]`,
+			want: []string{"i", "j", "m", "v", "xs"},
+		},
+		{
+			name: "named constants",
+			src:  "pi * r * r",
+			want: []string{"r"},
+		},
+		{
+			name: "constant",
+			src:  "1 + 2",
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Compile(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.FreeVars(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FreeVars() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
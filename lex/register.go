@@ -0,0 +1,181 @@
+package lex
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"unicode"
+)
+
+var (
+	valueType   = reflect.TypeOf((*Value)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
+// Go の関数を組み込み関数として登録する
+//
+// 引数と戻り値に使える型は数値型 (float64, int など), string, bool, Value。
+// 最後の引数が可変長 (...float64 など) なら可変個の引数を取る関数になる。
+// 最初の引数が context.Context なら評価の context (EvalContext などに渡したもの) を受け取る。
+// 戻り値は値1つ、値と error、error だけ (値は nil) のいずれか。
+// 返した error は *FuncError に包んで評価を止める
+//
+// 登録した関数はそのあと構文解析する式から使える
+func (ip *Interpreter) Register(name string, fn interface{}) error {
+	if !isIdent(name) {
+		return fmt.Errorf("register %q: invalid function name", name)
+	}
+	f, err := wrapFunc(name, fn)
+	if err != nil {
+		return err
+	}
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	ip.funcTable[name] = f
+	return nil
+}
+
+// 関数名に使えるか (識別子でキーワードでない)
+func isIdent(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		if !(c == '_' || unicode.IsLetter(c) || i > 0 && unicode.IsDigit(c)) {
+			return false
+		}
+	}
+	_, ok := keyTable[name]
+	return !ok
+}
+
+// Go の関数を FuncV に包む
+func wrapFunc(name string, fn interface{}) (Func, error) {
+	fv := reflect.ValueOf(fn)
+	t := fv.Type()
+	if t.Kind() != reflect.Func {
+		return nil, fmt.Errorf("register %v: %v is not a function", name, t)
+	}
+	first := 0
+	withCtx := t.NumIn() > 0 && t.In(0) == contextType
+	if withCtx {
+		first = 1
+	}
+	params := make([]reflect.Type, 0, t.NumIn())
+	for i := first; i < t.NumIn(); i++ {
+		p := t.In(i)
+		if t.IsVariadic() && i == t.NumIn()-1 {
+			p = p.Elem()
+		}
+		if !convertible(p) {
+			return nil, fmt.Errorf("register %v: unsupported argument type %v", name, p)
+		}
+		params = append(params, p)
+	}
+	withErr := t.NumOut() > 0 && t.Out(t.NumOut()-1) == errorType
+	switch {
+	case t.NumOut() == 1 && withErr:
+	case t.NumOut() == 1 || t.NumOut() == 2 && withErr:
+		if !convertible(t.Out(0)) {
+			return nil, fmt.Errorf("register %v: unsupported result type %v", name, t.Out(0))
+		}
+	default:
+		return nil, fmt.Errorf("register %v: function must return a value, an error or both", name)
+	}
+	argc := len(params)
+	if t.IsVariadic() {
+		argc--
+	}
+	return FuncV{argc, t.IsVariadic(), func(ip *Interpreter, xs []Value) Value {
+		args := make([]reflect.Value, 0, len(xs)+1)
+		if withCtx {
+			args = append(args, reflect.ValueOf(ip.evalContext()))
+		}
+		for i, x := range xs {
+			p := params[len(params)-1]
+			if i < len(params) {
+				p = params[i]
+			}
+			args = append(args, fromValue(name, i+1, x, p))
+		}
+		out := fv.Call(args)
+		if withErr {
+			if err := out[len(out)-1].Interface(); err != nil {
+				panic(&FuncError{Pos{}, name, err.(error)})
+			}
+			if len(out) == 1 {
+				return Nil{}
+			}
+		}
+		return toValue(out[0])
+	}}, nil
+}
+
+// 言語の値と変換できる型か
+func convertible(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.String, reflect.Bool:
+		return true
+	}
+	return t == valueType
+}
+
+// n 番目の引数 x を Go の型 t に変換する
+func fromValue(name string, n int, x Value, t reflect.Type) reflect.Value {
+	if t == valueType {
+		return reflect.ValueOf(&x).Elem()
+	}
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return reflect.ValueOf(toNum(x)).Convert(t)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f := toNum(x)
+		if f != math.Trunc(f) {
+			panic(runtimeError(Pos{}, "%v: argument %d: integer expected, got %v", name, n, f))
+		}
+		return reflect.ValueOf(int64(f)).Convert(t)
+	case reflect.String:
+		return reflect.ValueOf(toStr(x)).Convert(t)
+	case reflect.Bool:
+		b, ok := x.(Bool)
+		if !ok {
+			panic(runtimeError(Pos{}, "%v: argument %d: bool expected, got %v", name, n, x.Type()))
+		}
+		return reflect.ValueOf(bool(b)).Convert(t)
+	}
+	panic(fmt.Errorf("%v: unsupported argument type %v", name, t))
+}
+
+// Go の値を言語の値にする
+func toValue(v reflect.Value) Value {
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return Num(v.Float())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return Num(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return Num(v.Uint())
+	case reflect.String:
+		return Str(v.String())
+	case reflect.Bool:
+		return Bool(v.Bool())
+	}
+	if v.IsNil() {
+		return Nil{}
+	}
+	return v.Interface().(Value)
+}
+
+// 組み込み関数に渡す評価の context
+func (ip *Interpreter) evalContext() context.Context {
+	if ip.ctx == nil {
+		return context.Background()
+	}
+	return ip.ctx
+}
@@ -0,0 +1,180 @@
+package lex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type region string
+
+var errRegion = errors.New("unknown region")
+
+func TestInterpreter_Register(t *testing.T) {
+	ip := NewInterpreter()
+	funcs := map[string]interface{}{
+		"tax": func(amount float64, r region) (float64, error) {
+			switch r {
+			case "jp":
+				return amount * 0.1, nil
+			case "us":
+				return amount * 0.07, nil
+			}
+			return 0, errRegion
+		},
+		"add3":   func(a, b, c int) int { return a + b + c },
+		"concat": func(sep string, xs ...string) string { return strings.Join(xs, sep) },
+		"count":  func(xs ...Value) int { return len(xs) },
+		"either": func(b bool, x, y Value) Value {
+			if b {
+				return x
+			}
+			return y
+		},
+		"none":  func() Value { return nil },
+		"check": func(x float64) error { return nil },
+		"deadline": func(ctx context.Context) bool {
+			_, ok := ctx.Deadline()
+			return ok
+		},
+	}
+	for name, f := range funcs {
+		if err := ip.Register(name, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name    string
+		src     string
+		want    Value
+		wantErr error
+	}{
+		{
+			name: "two arguments",
+			src:  `tax(1000, "jp")`,
+			want: Num(100),
+		},
+		{
+			name:    "returned error",
+			src:     `tax(1000, "xx")`,
+			wantErr: errRegion,
+		},
+		{
+			name: "int arguments",
+			src:  "add3(1, 2, 3)",
+			want: Num(6),
+		},
+		{
+			name:    "not an integer",
+			src:     "add3(1, 2, 3.5)",
+			wantErr: errAny,
+		},
+		{
+			name:    "wrong arity",
+			src:     "add3(1, 2)",
+			wantErr: errAny,
+		},
+		{
+			name: "variadic",
+			src:  `concat("-", "a", "b", "c")`,
+			want: Str("a-b-c"),
+		},
+		{
+			name: "variadic without rest",
+			src:  `concat("-")`,
+			want: Str(""),
+		},
+		{
+			name: "variadic values",
+			src:  `count(1, "a", [2])`,
+			want: Num(3),
+		},
+		{
+			name: "values",
+			src:  `either(1 < 2, "yes", [0])`,
+			want: Str("yes"),
+		},
+		{
+			name:    "bool expected",
+			src:     `either(1, "yes", "no")`,
+			wantErr: errAny,
+		},
+		{
+			name: "nil result",
+			src:  "none()",
+			want: Nil{},
+		},
+		{
+			name: "error only",
+			src:  "check(1)",
+			want: Nil{},
+		},
+		{
+			name: "as function value",
+			src:  "map(fn(x) add3(x, x, x) end, [1, 2])",
+			want: nums(3, 6),
+		},
+		{
+			name: "context",
+			src:  "deadline()",
+			want: Bool(true),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			got, err := func() (Value, error) {
+				e, err := ip.Parse(tt.src)
+				if err != nil {
+					return nil, err
+				}
+				return ip.EvalContext(ctx, e)
+			}()
+			switch {
+			case tt.wantErr == errAny:
+				if err == nil {
+					t.Errorf("error = nil, want error")
+				}
+			case tt.wantErr != nil:
+				var fe *FuncError
+				if !errors.Is(err, tt.wantErr) || !errors.As(err, &fe) || !fe.Pos.IsValid() {
+					t.Errorf("error = %v, want FuncError wrapping %v", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Errorf("error = %v", err)
+			case !reflect.DeepEqual(got, tt.want):
+				t.Errorf("Eval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+var errAny = errors.New("any error")
+
+func TestInterpreter_RegisterInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   interface{}
+	}{
+		{name: "f", fn: 1},
+		{name: "f", fn: func(x []int) float64 { return 0 }},
+		{name: "f", fn: func(x float64) {}},
+		{name: "f", fn: func(x float64) (float64, float64) { return 0, 0 }},
+		{name: "f", fn: func(x float64) map[string]int { return nil }},
+		{name: "if", fn: func() float64 { return 0 }},
+		{name: "1f", fn: func() float64 { return 0 }},
+		{name: "", fn: func() float64 { return 0 }},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			if err := NewInterpreter().Register(tt.name, tt.fn); err == nil {
+				t.Errorf("Register(%q, %T) error = nil", tt.name, tt.fn)
+			}
+		})
+	}
+}
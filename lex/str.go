@@ -0,0 +1,89 @@
+package lex
+
+import (
+	"strconv"
+	"strings"
+)
+
+// 文字列の組み込み関数
+func initStrFunc() {
+	builtinTable["len"] = FuncV{1, false, strLen}
+	builtinTable["substr"] = FuncV{3, false, substr}
+	builtinTable["split"] = FuncV{2, false, split}
+	builtinTable["join"] = FuncV{2, false, join}
+	builtinTable["upper"] = FuncV{1, false, func(ip *Interpreter, xs []Value) Value {
+		return Str(strings.ToUpper(toStr(xs[0])))
+	}}
+	builtinTable["lower"] = FuncV{1, false, func(ip *Interpreter, xs []Value) Value {
+		return Str(strings.ToLower(toStr(xs[0])))
+	}}
+	builtinTable["str"] = FuncV{1, false, func(ip *Interpreter, xs []Value) Value {
+		return Str(display(xs[0]))
+	}}
+	builtinTable["num"] = FuncV{1, false, num}
+}
+
+// 文字数 (リストなら要素数、連想配列ならキーの数)
+func strLen(ip *Interpreter, xs []Value) Value {
+	switch x := xs[0].(type) {
+	case *List:
+		return Num(len(x.elems))
+	case *Map:
+		return Num(len(x.keys))
+	}
+	return Num(len([]rune(toStr(xs[0]))))
+}
+
+// substr(s, i, n): i 文字目 (0 から数える) から n 文字
+func substr(ip *Interpreter, xs []Value) Value {
+	s := []rune(toStr(xs[0]))
+	i := toIndex(xs[1])
+	n := toIndex(xs[2])
+	if i < 0 || n < 0 || i+n > len(s) {
+		panic(runtimeError(Pos{}, "substr: index out of range: %v, %v", i, n))
+	}
+	return Str(s[i : i+n])
+}
+
+// split(s, sep): 区切り文字列で分割したリスト
+func split(ip *Interpreter, xs []Value) Value {
+	ss := strings.Split(toStr(xs[0]), toStr(xs[1]))
+	elems := make([]Value, len(ss))
+	for i, s := range ss {
+		elems[i] = Str(s)
+	}
+	return newList(elems)
+}
+
+// join(xs, sep): リストの要素を区切り文字列でつないだ文字列
+func join(ip *Interpreter, xs []Value) Value {
+	l := toList(xs[0])
+	ss := make([]string, len(l.elems))
+	for i, x := range l.elems {
+		ss[i] = display(x)
+	}
+	return Str(strings.Join(ss, toStr(xs[1])))
+}
+
+// 文字列を数値に変換する
+func num(ip *Interpreter, xs []Value) Value {
+	if n, ok := xs[0].(Num); ok {
+		return n
+	}
+	s := toStr(xs[0])
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		panic(runtimeError(Pos{}, "num: invalid number: %q", s))
+	}
+	return Num(n)
+}
+
+// 整数の添字を取り出す
+func toIndex(v Value) int {
+	x := toNum(v)
+	i := int(x)
+	if float64(i) != x {
+		panic(runtimeError(Pos{}, "integer expected, got %v", x))
+	}
+	return i
+}
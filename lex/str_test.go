@@ -0,0 +1,143 @@
+package lex
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStr(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    Value
+		wantErr bool
+	}{
+		{
+			name: "literal",
+			src:  `"abc"`,
+			want: Str("abc"),
+		},
+		{
+			name: "escape",
+			src:  `"a\tb"`,
+			want: Str("a\tb"),
+		},
+		{
+			name: "concat",
+			src:  `s = "foo"; s + "bar"`,
+			want: Str("foobar"),
+		},
+		{
+			name: "equal",
+			src:  `"abc" == "abc"`,
+			want: Bool(true),
+		},
+		{
+			name: "not equal to number",
+			src:  `"1" == 1`,
+			want: Bool(false),
+		},
+		{
+			name: "less than",
+			src:  `"abc" < "abd"`,
+			want: Bool(true),
+		},
+		{
+			name: "len",
+			src:  `len("日本語")`,
+			want: Num(3),
+		},
+		{
+			name: "substr",
+			src:  `substr("calculator", 4, 3)`,
+			want: Str("ula"),
+		},
+		{
+			name: "split",
+			src:  `split("a,b,c", ",")`,
+			want: newList([]Value{Str("a"), Str("b"), Str("c")}),
+		},
+		{
+			name: "join",
+			src:  `join(split("a b c", " "), "-")`,
+			want: Str("a-b-c"),
+		},
+		{
+			name: "upper",
+			src:  `upper("abc")`,
+			want: Str("ABC"),
+		},
+		{
+			name: "lower",
+			src:  `lower("ABC")`,
+			want: Str("abc"),
+		},
+		{
+			name: "str",
+			src:  `"total: " + str(1.5 * 2)`,
+			want: Str("total: 3"),
+		},
+		{
+			name: "num",
+			src:  `num("2.5") * 2`,
+			want: Num(5),
+		},
+		{
+			name:    "string minus number",
+			src:     `"a" - 1`,
+			wantErr: true,
+		},
+		{
+			name:    "substr out of range",
+			src:     `substr("abc", 2, 5)`,
+			wantErr: true,
+		},
+		{
+			name:    "sqrt of string",
+			src:     `sqrt("4")`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := evalString(tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Eval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_display(t *testing.T) {
+	tests := []struct {
+		name string
+		v    Value
+		want string
+	}{
+		{
+			name: "number",
+			v:    Num(1.5),
+			want: "1.5",
+		},
+		{
+			name: "string",
+			v:    Str("abc"),
+			want: "abc",
+		},
+		{
+			name: "list",
+			v:    newList([]Value{Num(1), Str("a")}),
+			want: `[1, "a"]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := display(tt.v); got != tt.want {
+				t.Errorf("display() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,120 +1,154 @@
 package lex
 
-import "fmt"
-
-type Value float64
-
 // 局所変数の環境
+// 関数の引数、let、for ごとに1つ作り、変数は構文解析のときに決めた位置 (addr) で読み書きする
 type Env struct {
-	name Variable
-	val  Value
+	vals []Value
 	next *Env
 }
 
-func newEnv(name Variable, val Value, next *Env) *Env {
-	return &Env{name, val, next}
+// 変数束縛
+// 関数の本体は定義したときの環境 next に引数の環境を加えた環境で評価する
+func newEnv(vals []Value, next *Env) *Env {
+	return &Env{vals, next}
 }
 
-//  変数束縛
-func makeBinding(xs []Variable, es []Expr, env *Env) *Env {
-	var env1 *Env
-	for i := 0; i < len(xs); i++ {
-		env1 = newEnv(xs[i], es[i].Eval(env), env1)
+// n 個の局所変数の環境を作る
+// 小さい環境は値の配列と一緒に1回で確保する
+func makeEnv(n int, next *Env) *Env {
+	switch n {
+	case 0:
+		return &Env{nil, next}
+	case 1:
+		e := &struct {
+			Env
+			a [1]Value
+		}{}
+		e.Env = Env{e.a[:], next}
+		return &e.Env
+	case 2:
+		e := &struct {
+			Env
+			a [2]Value
+		}{}
+		e.Env = Env{e.a[:], next}
+		return &e.Env
+	case 3:
+		e := &struct {
+			Env
+			a [3]Value
+		}{}
+		e.Env = Env{e.a[:], next}
+		return &e.Env
+	default:
+		return &Env{make([]Value, n), next}
 	}
-	return env1
 }
 
 // 構文木の型
 type Expr interface {
-	Eval(*Env) Value
+	Eval(*Interpreter, *Env) Value
 }
 
-// 局所変数の参照
-func lookUp(name Variable, env *Env) (Value, bool) {
-	for ; env != nil; env = env.next {
-		if name == env.name {
-			return env.val, true
-		}
-	}
-	return 0.0, false
+// 局所変数の位置
+// depth 個外側の環境の slot 番目。local が false なら大域変数 (名前で探す)
+type addr struct {
+	local       bool
+	depth, slot int
 }
 
-// 局所変数の更新
-func update(name Variable, val Value, env *Env) bool {
-	for ; env != nil; env = env.next {
-		if name == env.name {
-			env.val = val
-			return true
-		}
+// 変数のある環境
+func (a addr) frame(env *Env) *Env {
+	for i := a.depth; i > 0; i-- {
+		env = env.next
 	}
-	return false
+	return env
 }
 
-func (e Value) Eval(env *Env) Value {
-	return e
-}
-
-//  単項演算子
+// 単項演算子
 type Op1 struct {
+	span
 	code rune
 	expr Expr
 }
 
 func newOp1(code rune, e Expr) Expr {
-	return &Op1{code, e}
+	return &Op1{code: code, expr: e}
 }
 
 // 単項演算子の評価
-func (e *Op1) Eval(env *Env) Value {
-	v := e.expr.Eval(env)
-	switch e.code {
-	case '-':
-		return -v
-	case '+':
-		return v
-	case NOT:
-		return boolToValue(isFalse(v))
-	default:
-		panic(fmt.Errorf("invalid Op1 code"))
+func (e *Op1) Eval(ip *Interpreter, env *Env) Value {
+	ip.tick(e.start)
+	return e.apply(e.expr.Eval(ip, env))
+}
+
+func (e *Op1) apply(x Value) Value {
+	v, err := applyOp1(e.code, x)
+	if err != nil {
+		panic(runtimeError(e.start, "%v", err))
 	}
+	return v
 }
 
 // 二項演算子
 type Op2 struct {
+	span
 	code        rune
 	left, right Expr
 }
 
 func newOp2(code rune, left, right Expr) Expr {
-	return &Op2{code, left, right}
+	return &Op2{code: code, left: left, right: right}
 }
 
 // 二項演算子の評価
-func (e *Op2) Eval(env *Env) Value {
-	x := e.left.Eval(env)
-	y := e.right.Eval(env)
-	switch e.code {
-	case '+':
-		return x + y
-	case '-':
-		return x - y
-	case '*':
-		return x * y
-	case '/':
-		return x / y
-	case EQ:
-		return boolToValue(x == y)
-	case NE:
-		return boolToValue(x != y)
-	case LT:
-		return boolToValue(x < y)
-	case GT:
-		return boolToValue(x > y)
-	case LE:
-		return boolToValue(x <= y)
-	case GE:
-		return boolToValue(x >= y)
-	default:
-		panic(fmt.Errorf("invalid op code"))
+func (e *Op2) Eval(ip *Interpreter, env *Env) Value {
+	ip.tick(e.start)
+	x := e.left.Eval(ip, env)
+	y := e.right.Eval(ip, env)
+	return e.apply(x, y)
+}
+
+func (e *Op2) apply(x, y Value) Value {
+	v, err := applyOp2(e.code, x, y)
+	if err != nil {
+		panic(runtimeError(e.start, "%v", err))
+	}
+	return v
+}
+
+// 連鎖した比較演算子 (a < b < c)
+// 途中の式は1回だけ評価し、偽になったところで止める
+type Chain struct {
+	span
+	codes []rune
+	xs    []Expr
+}
+
+func newChain(codes []rune, xs []Expr) Expr {
+	return &Chain{codes: codes, xs: xs}
+}
+
+func (e *Chain) Eval(ip *Interpreter, env *Env) Value {
+	ip.tick(e.start)
+	x := e.xs[0].Eval(ip, env)
+	var v Value
+	for i := range e.codes {
+		y := e.xs[i+1].Eval(ip, env)
+		v = e.compare(i, x, y)
+		if !isTrue(v) {
+			return v
+		}
+		x = y
+	}
+	return v
+}
+
+// i 番目の比較
+func (e *Chain) compare(i int, x, y Value) Value {
+	v, err := applyOp2(e.codes[i], x, y)
+	if err != nil {
+		panic(runtimeError(e.start, "%v", err))
 	}
+	return v
 }
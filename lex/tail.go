@@ -0,0 +1,57 @@
+package lex
+
+// 末尾呼び出しの最適化
+// 関数の本体の末尾位置 (if の分岐、begin の最後の式、let の本体) にある
+// ユーザ定義関数の呼び出しは、呼び出し元に戻ってから呼び出す。
+// 呼び出しの深さが増えないので、末尾再帰は Go のスタックを使わずに繰り返しになる。
+// 終わらない末尾再帰は MaxDepth ではなく、while と同じく歩数・時間の上限や中断で止める
+
+// 末尾位置で呼び出す関数
+type tailCall struct {
+	pos Pos    // 関数に入る位置 (enterCall のエラーの位置)
+	at  Pos    // 関数値を呼び出した位置 (呼び出した先のエラーの位置にする)
+	f   *FuncU // nil なら末尾呼び出しではない
+	env *Env   // 引数の環境
+}
+
+// 関数の本体を評価する
+// 末尾位置のユーザ定義関数の呼び出しは評価せずに返す
+func (ip *Interpreter) evalTail(e Expr, env *Env) (Value, tailCall) {
+	switch e := e.(type) {
+	case *Sel:
+		ip.tick(e.start)
+		if isTrue(e.testForm.Eval(ip, env)) {
+			return ip.evalTail(e.thenForm, env)
+		}
+		return ip.evalTail(e.elseForm, env)
+	case *Bgn:
+		if len(e.body) == 0 {
+			return Num(0), tailCall{}
+		}
+		for _, x := range e.body[:len(e.body)-1] {
+			x.Eval(ip, env)
+		}
+		return ip.evalTail(e.body[len(e.body)-1], env)
+	case *Let:
+		ip.tick(e.start)
+		return ip.evalTail(e.body, e.bind(ip, env))
+	case *App:
+		if f, ok := e.fn.(*FuncU); ok {
+			ip.tick(e.start)
+			return nil, tailCall{pos: e.start, f: f, env: e.args(ip, env)}
+		}
+	case *Call:
+		ip.tick(e.start)
+		v := e.fn.Eval(ip, env)
+		xs := make([]Value, len(e.xs))
+		for i, x := range e.xs {
+			xs[i] = x.Eval(ip, env)
+		}
+		f, fenv, r := e.prepare(ip, v, xs)
+		if f == nil {
+			return r, tailCall{}
+		}
+		return nil, tailCall{at: e.start, f: f, env: fenv}
+	}
+	return e.Eval(ip, env), tailCall{}
+}
@@ -0,0 +1,129 @@
+package lex
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTailCall(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want Value
+	}{
+		{
+			name: "accumulator",
+			src:  "def loop(n, acc) if n == 0 then acc else loop(n - 1, acc + n) end end loop(100000, 0)",
+			want: Num(5000050000),
+		},
+		{
+			name: "mutual recursion",
+			src: "declare odd(n); def even(n) if n == 0 then true else odd(n - 1) end end " +
+				"def odd(n) if n == 0 then false else even(n - 1) end end even(100001)",
+			want: Bool(false),
+		},
+		{
+			name: "closure",
+			src:  "count = fn(n, acc) if n == 0 then acc else count(n - 1, acc + 1) end end; count(100000, 0)",
+			want: Num(100000),
+		},
+		{
+			name: "through begin and let",
+			src:  "def f(n, acc) if n == 0 then acc else begin 0, let m = n - 1 in f(m, acc + 2) end end end end f(100000, 0)",
+			want: Num(200000),
+		},
+		{
+			name: "captured environment",
+			src:  "def make(k) fn(n) if n == 0 then k else f(n - 1) end end end f = make(7); f(100000)",
+			want: Num(7),
+		},
+		{
+			name: "builtin in tail position",
+			src:  "def f(n) if n == 0 then sqrt(16) else f(n - 1) end end f(100000)",
+			want: Num(4),
+		},
+		{
+			name: "not in tail position",
+			src:  "def total(n) if n == 0 then 0 else n + total(n - 1) end end total(50)",
+			want: Num(1275),
+		},
+	}
+	for _, b := range []Backend{TreeWalk, Bytecode} {
+		for _, tt := range tests {
+			t.Run(b.String()+"/"+tt.name, func(t *testing.T) {
+				ip := NewInterpreter()
+				ip.Backend = b
+				ip.MaxDepth = 100
+				e, err := ip.Parse(tt.src)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := ip.Eval(e)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("Eval() = %v, want %v", got, tt.want)
+				}
+				if len(ip.calls) != 0 {
+					t.Errorf("calls = %d after Eval()", len(ip.calls))
+				}
+			})
+		}
+	}
+}
+
+// 末尾呼び出しで置き換えた関数は呼び出しの連鎖に残らない
+func TestTailCall_Chain(t *testing.T) {
+	for _, b := range []Backend{TreeWalk, Bytecode} {
+		ip := NewInterpreter()
+		ip.Backend = b
+		ip.MaxDepth = 3
+		e, err := ip.Parse("def g(n) g(n + 1) + 1 end def f(n) if n == 0 then g(0) else f(n - 1) end end f(10)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ip.Eval(e)
+		var re *RecursionError
+		if !errors.As(err, &re) {
+			t.Fatalf("%v: Eval() error = %v, want RecursionError", b, err)
+		}
+		if want := "(4 calls): g -> g -> g -> g"; !strings.Contains(err.Error(), want) {
+			t.Errorf("%v: Error() = %q, want chain %q", b, err.Error(), want)
+		}
+	}
+}
+
+// 終わらない末尾再帰は深さではなく歩数や時間の上限で止まる
+func TestTailCall_Limits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		limit  string
+	}{
+		{"steps", Limits{MaxSteps: 10000}, "steps"},
+		{"timeout", Limits{Timeout: 20 * time.Millisecond}, "timeout"},
+	}
+	for _, b := range []Backend{TreeWalk, Bytecode} {
+		for _, tt := range tests {
+			t.Run(b.String()+"/"+tt.name, func(t *testing.T) {
+				ip := NewInterpreter()
+				ip.Backend = b
+				ip.MaxDepth = 10
+				ip.Limits = tt.limits
+				e, err := ip.Parse("def f(n) f(n + 1) end f(0)")
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = ip.Eval(e)
+				var le *LimitError
+				if !errors.As(err, &le) || le.Limit != tt.limit {
+					t.Errorf("Eval() error = %v, want %v limit", err, tt.limit)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package lex
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 値
+// 値はそのまま構文木 (定数) としても使える
+// 演算子は型ごとに演算子表 (op.go) で定義する
+type Value interface {
+	Expr
+	Type() Type     // 型
+	String() string // 表示用の文字列
+}
+
+// 値の型
+type Type string
+
+const (
+	NumType  Type = "number"
+	BoolType Type = "bool"
+	StrType  Type = "string"
+	ListType Type = "list"
+	MapType  Type = "map"
+	FuncType Type = "function"
+	NilType  Type = "nil"
+)
+
+// 数値
+type Num float64
+
+func (n Num) Eval(ip *Interpreter, env *Env) Value {
+	return n
+}
+
+func (n Num) Type() Type {
+	return NumType
+}
+
+func (n Num) String() string {
+	return fmt.Sprint(float64(n))
+}
+
+// 文字列
+type Str string
+
+func (s Str) Eval(ip *Interpreter, env *Env) Value {
+	return s
+}
+
+func (s Str) Type() Type {
+	return StrType
+}
+
+// リストの要素などでは引用符を付けて表示する
+func (s Str) String() string {
+	return strconv.Quote(string(s))
+}
+
+// リスト
+type List struct {
+	elems []Value
+}
+
+func newList(elems []Value) *List {
+	return &List{elems}
+}
+
+func (xs *List) Eval(ip *Interpreter, env *Env) Value {
+	return xs
+}
+
+func (xs *List) Type() Type {
+	return ListType
+}
+
+func (xs *List) String() string {
+	var b strings.Builder
+	writeValue(&b, xs, nil)
+	return b.String()
+}
+
+// 表示や比較でたどる入れ子の深さの上限
+// Go のスタックが溢れる前に止める
+const maxNesting = 10000
+
+// v を b に書く
+// path はたどっている途中のリストと連想配列。自分自身を含むものや深すぎる入れ子は [...], {...} と書く
+func writeValue(b *strings.Builder, v Value, path []Value) {
+	switch x := v.(type) {
+	case *List:
+		if len(path) >= maxNesting || inPath(path, x) {
+			b.WriteString("[...]")
+			return
+		}
+		path = append(path, x)
+		b.WriteByte('[')
+		for i, e := range x.elems {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeValue(b, e, path)
+		}
+		b.WriteByte(']')
+	case *Map:
+		if len(path) >= maxNesting || inPath(path, x) {
+			b.WriteString("{...}")
+			return
+		}
+		path = append(path, x)
+		b.WriteByte('{')
+		for i, k := range x.keys {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(k.String())
+			b.WriteString(": ")
+			writeValue(b, x.vals[k], path)
+		}
+		b.WriteByte('}')
+	default:
+		b.WriteString(v.String())
+	}
+}
+
+func inPath(path []Value, v Value) bool {
+	for _, x := range path {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// 真偽値
+type Bool bool
+
+func (b Bool) Eval(ip *Interpreter, env *Env) Value {
+	return b
+}
+
+func (b Bool) Type() Type {
+	return BoolType
+}
+
+func (b Bool) String() string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
+
+// 値がないことを表す
+type Nil struct{}
+
+func (n Nil) Eval(ip *Interpreter, env *Env) Value {
+	return n
+}
+
+func (n Nil) Type() Type {
+	return NilType
+}
+
+func (n Nil) String() string {
+	return "nil"
+}
+
+// 関数値
+type FuncVal struct {
+	name string
+	fn   Func
+	env  *Env // 無名関数が捕まえた環境
+}
+
+func newFuncVal(name string, fn Func) *FuncVal {
+	return &FuncVal{name: name, fn: fn}
+}
+
+func (f *FuncVal) Eval(ip *Interpreter, env *Env) Value {
+	return f
+}
+
+func (f *FuncVal) Type() Type {
+	return FuncType
+}
+
+func (f *FuncVal) String() string {
+	if f.name == "" {
+		return "<function>"
+	}
+	return "<function " + f.name + ">"
+}
+
+// トップレベルでの表示
+// 文字列は引用符を付けずにそのまま表示する
+func display(v Value) string {
+	if s, ok := v.(Str); ok {
+		return string(s)
+	}
+	return v.String()
+}
+
+// 文の値を表示する文字列
+// 真偽値は BoolNames でなければ 1, 0 と表示する
+func (ip *Interpreter) show(v Value) string {
+	if b, ok := v.(Bool); ok && !ip.BoolNames {
+		return Num(asNum(b)).String()
+	}
+	return display(v)
+}
+
+// 数値として扱える値 (数値と真偽値) から数値を取り出す
+func asNum(v Value) float64 {
+	if b, ok := v.(Bool); ok {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	return float64(v.(Num))
+}
+
+// 数値を取り出す
+func toNum(v Value) float64 {
+	switch v.(type) {
+	case Num, Bool:
+		return asNum(v)
+	default:
+		panic(runtimeError(Pos{}, "number expected, got %v", v.Type()))
+	}
+}
+
+// 文字列を取り出す
+func toStr(v Value) string {
+	s, ok := v.(Str)
+	if !ok {
+		panic(runtimeError(Pos{}, "string expected, got %v", v.Type()))
+	}
+	return string(s)
+}
+
+// リストを取り出す
+func toList(v Value) *List {
+	xs, ok := v.(*List)
+	if !ok {
+		panic(runtimeError(Pos{}, "list expected, got %v", v.Type()))
+	}
+	return xs
+}
+
+// 関数値を取り出す
+func toFunc(v Value) *FuncVal {
+	f, ok := v.(*FuncVal)
+	if !ok {
+		panic(runtimeError(Pos{}, "function expected, got %v", v.Type()))
+	}
+	return f
+}
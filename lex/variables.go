@@ -12,54 +12,142 @@ func init() {
 // 変数
 type Variable string
 
-// 大域的な環境
-var globalEnv = make(map[Variable]Value)
-
-// テスト用
-func resetGlobal() {
-	globalEnv = make(map[Variable]Value)
+// 変数の評価
+// 局所変数はソース上の参照 (VarRef) が位置を持つので、ここでは大域の名前だけを探す
+func (v Variable) Eval(ip *Interpreter, env *Env) Value {
+	return v.lookUp(ip, Pos{})
 }
 
-// 変数の評価
-func (v Variable) Eval(env *Env) Value {
-	// 局所変数の探索
-	val, ok := lookUp(v, env)
-	if ok {
+// 局所変数でない変数の探索
+// 見つからなければ pos の位置でエラーにする
+func (v Variable) lookUp(ip *Interpreter, pos Pos) Value {
+	// 定数の探索
+	if val, ok := ip.lookUpConst(v); ok {
 		return val
 	}
 	// 大域変数の探索
-	val, ok = globalEnv[v]
-	if !ok {
-		panic(fmt.Errorf("unbound variable: %v", v))
+	val, ok := ip.globalEnv[v]
+	if ok {
+		return val
 	}
-	return val
+	// 外から与えた変数の探索
+	if ip.vars != nil {
+		if val, ok := ip.vars.Resolve(string(v)); ok {
+			return val
+		}
+	}
+	// 関数表の探索
+	// 定義より前に書いた呼び出しは評価するときに関数を探す
+	if f, ok := ip.funcTable[string(v)]; ok && ip.Policy.allowFunc(string(v)) {
+		return newFuncVal(string(v), f)
+	}
+	// 物理定数の探索
+	if val, ok := physTable[v]; ok {
+		return val
+	}
+	panic(&UnboundVariableError{pos, v})
+}
+
+// ソース上の変数の参照
+type VarRef struct {
+	span
+	name Variable
+	addr // 局所変数なら環境の中の位置
+}
+
+func newVarRef(name Variable) *VarRef {
+	return &VarRef{name: name}
+}
+
+func (v *VarRef) Eval(ip *Interpreter, env *Env) Value {
+	ip.tick(v.start)
+	return ip.load(v.start, v.name, v.addr, env)
+}
+
+// 変数の値を読む
+// 局所変数なら環境の at の位置、そうでなければ名前で探す
+func (ip *Interpreter) load(pos Pos, name Variable, at addr, env *Env) Value {
+	if at.local {
+		return at.frame(env).vals[at.slot]
+	}
+	return name.lookUp(ip, pos)
 }
 
 // 代入演算子
 type Agn struct {
+	span
 	name Variable
+	addr
 	expr Expr
 }
 
 func newAgn(v Variable, e Expr) *Agn {
-	return &Agn{v, e}
+	return &Agn{name: v, expr: e}
 }
 
 // 代入式の評価
-func (a *Agn) Eval(env *Env) Value {
-	val := a.expr.Eval(env)
-	if !update(a.name, val, env) {
-		globalEnv[a.name] = val
-	}
+func (a *Agn) Eval(ip *Interpreter, env *Env) Value {
+	ip.tick(a.start)
+	val := a.expr.Eval(ip, env)
+	ip.assign(a.start, a.name, a.addr, val, env)
 	return val
 }
 
+// 変数に代入する
+// 局所変数でなければ大域変数に代入する (定数には代入できない)
+func (ip *Interpreter) assign(pos Pos, name Variable, at addr, val Value, env *Env) {
+	if at.local {
+		at.frame(env).vals[at.slot] = val
+		return
+	}
+	if _, ok := ip.lookUpConst(name); ok {
+		panic(runtimeError(pos, "cannot assign to constant %v", name))
+	}
+	ip.checkGlobals(pos, name)
+	ip.globalEnv[name] = val
+}
+
+// 複合代入演算子 (+= など)
+type OpAgn struct {
+	span
+	name Variable
+	addr
+	code rune // 演算子
+	expr Expr
+}
+
+func newOpAgn(v Variable, code rune, e Expr) *OpAgn {
+	return &OpAgn{name: v, code: code, expr: e}
+}
+
+// x op= e は x = x op e と同じ
+func (a *OpAgn) Eval(ip *Interpreter, env *Env) Value {
+	ip.tick(a.start)
+	x := ip.load(a.start, a.name, a.addr, env)
+	return a.apply(ip, x, a.expr.Eval(ip, env), env)
+}
+
+// 変数の値 x と右辺の値 y から計算して代入する
+func (a *OpAgn) apply(ip *Interpreter, x, y Value, env *Env) Value {
+	val, err := applyOp2(a.code, x, y)
+	if err != nil {
+		panic(runtimeError(a.start, "%v", err))
+	}
+	ip.assign(a.start, a.name, a.addr, val, env)
+	return val
+}
 
 // 組み込み関数 引数の個数を持てるもの
 type Func interface {
 	Argc() int // 引数の個数
 }
 
+type Func0 func() float64
+
+func (f Func0) Argc() int {
+	return 0
+}
+
 type Func1 func(float64) float64
 
 func (f Func1) Argc() int {
@@ -72,8 +160,34 @@ func (f Func2) Argc() int {
 	return 2
 }
 
+// 値を受け取る組み込み関数
+type FuncV struct {
+	argc     int
+	variadic bool // true なら argc 個以上の引数を取る
+	fn       func(ip *Interpreter, xs []Value) Value
+}
+
+func (f FuncV) Argc() int {
+	return f.argc
+}
+
+// 引数の個数が合うか
+func arityOK(f Func, n int) bool {
+	if v, ok := f.(FuncV); ok && v.variadic {
+		return n >= v.argc
+	}
+	return n == f.Argc()
+}
+
+// 引数の個数のエラー
+func arityError(pos Pos, name string, f Func, n int) *ArityError {
+	v, ok := f.(FuncV)
+	return &ArityError{pos, name, f.Argc(), n, ok && v.variadic}
+}
+
 // 組み込み関数の構文木
 type App struct {
+	span
 	fn Func
 	xs []Expr
 }
@@ -83,42 +197,184 @@ func newApp(fn Func, xs []Expr) *App {
 }
 
 // 関数の評価(組み込み、ユーザ定義)
-func (a *App) Eval(env *Env) Value {
-	switch f := a.fn.(type) {
+func (a *App) Eval(ip *Interpreter, env *Env) Value {
+	ip.tick(a.start)
+	if f, ok := a.fn.(*FuncU); ok {
+		return ip.callUser(a.start, f, a.args(ip, env))
+	}
+	xs := make([]Value, len(a.xs))
+	for i, x := range a.xs {
+		xs[i] = x.Eval(ip, env)
+	}
+	return a.callBuiltin(ip, xs)
+}
+
+// ユーザ定義関数の引数の環境
+// 引数はそのまま関数の環境に入れる
+func (a *App) args(ip *Interpreter, env *Env) *Env {
+	fenv := makeEnv(len(a.xs), nil)
+	for i, x := range a.xs {
+		fenv.vals[i] = x.Eval(ip, env)
+	}
+	return fenv
+}
+
+// 組み込み関数のエラーは呼び出した位置にする
+func (a *App) callBuiltin(ip *Interpreter, xs []Value) Value {
+	defer locate(a.start)
+	return ip.callBuiltin(a.fn, xs)
+}
+
+// バイトコードの組み込み関数の呼び出し (args はスタックの上の値)
+func (a *App) callBuiltinArgs(ip *Interpreter, args []Value) Value {
+	defer locate(a.start)
+	return ip.callBuiltinArgs(a.fn, args)
+}
+
+// 関数値の呼び出し
+func (ip *Interpreter) call(f *FuncVal, xs []Value) Value {
+	checkArity(f, len(xs))
+	if u, ok := f.fn.(*FuncU); ok {
+		// 引数は関数の環境に複製する (呼び出し元の配列を共有しない)
+		env := makeEnv(len(xs), f.env)
+		copy(env.vals, xs)
+		return ip.callUser(Pos{}, u, env)
+	}
+	return ip.callBuiltin(f.fn, xs)
+}
+
+func checkArity(f *FuncVal, n int) {
+	if !arityOK(f.fn, n) {
+		panic(arityError(Pos{}, f.name, f.fn, n))
+	}
+}
+
+// ユーザ定義関数の呼び出し
+// env は引数の環境で、その外側はクロージャが捕まえた環境 (def で定義した関数なら nil)
+// 本体の末尾位置の呼び出しは、深さを増やさずにここで繰り返す
+func (ip *Interpreter) callUser(pos Pos, f *FuncU, env *Env) Value {
+	f = ip.enterCall(pos, f)
+	// 末尾位置で関数値を呼び出した位置 (Call.Eval の locate の代わり)
+	var at Pos
+	defer func() {
+		if at.IsValid() {
+			if r := recover(); r != nil {
+				setPos(r, at)
+				panic(r)
+			}
+		}
+	}()
+	var pending memoPending
+	for {
+		if v, ok := pending.enter(f, env); ok {
+			ip.leaveCall()
+			pending.store(v)
+			return v
+		}
+		if ip.Backend == Bytecode && f.code != nil {
+			v := ip.run(f.code, env)
+			ip.leaveCall()
+			pending.store(v)
+			return v
+		}
+		v, t := ip.evalTail(f.body, env)
+		if t.f == nil {
+			ip.leaveCall()
+			pending.store(v)
+			return v
+		}
+		if t.at.IsValid() {
+			at = t.at
+		}
+		f, env = ip.replaceCall(t.pos, t.f), t.env
+	}
+}
+
+// ユーザ定義関数に入る
+// 呼び出しが深くなりすぎたら Go のスタックが溢れる前に pos の位置でエラーにする
+// 呼び出す関数 (再定義したものがあればそちら) を返す
+func (ip *Interpreter) enterCall(pos Pos, f *FuncU) *FuncU {
+	f = ip.userFunc(f)
+	if f.body == nil {
+		panic(runtimeError(pos, "%v is declared but not defined", f.name))
+	}
+	ip.checkInterrupt(pos)
+	if len(ip.calls) >= ip.maxDepth() {
+		chain := make([]string, len(ip.calls), len(ip.calls)+1)
+		copy(chain, ip.calls)
+		panic(&RecursionError{pos, append(chain, f.name)})
+	}
+	ip.calls = append(ip.calls, f.name)
+	return f
+}
+
+func (ip *Interpreter) leaveCall() {
+	ip.calls = ip.calls[:len(ip.calls)-1]
+}
+
+// 末尾呼び出しで実行中の関数を f に置き換える
+// 呼び出しの連鎖の最後を入れ替えるので、深さは変わらない
+func (ip *Interpreter) replaceCall(pos Pos, f *FuncU) *FuncU {
+	ip.leaveCall()
+	return ip.enterCall(pos, f)
+}
+
+// 組み込み関数の呼び出し
+func (ip *Interpreter) callBuiltin(fn Func, xs []Value) Value {
+	switch f := fn.(type) {
+	case Func0:
+		return Num(f())
 	case Func1:
-		x := float64(a.xs[0].Eval(env))
-		return Value(f(x))
+		return Num(f(toNum(xs[0])))
 	case Func2:
-		x := float64(a.xs[0].Eval(env))
-		y := float64(a.xs[1].Eval(env))
-		return Value(f(x, y))
-	case *FuncU:
-		return f.body.Eval(makeBinding(f.xs, a.xs, env))
+		return Num(f(toNum(xs[0]), toNum(xs[1])))
+	case FuncV:
+		return f.fn(ip, xs)
 	default:
 		panic(fmt.Errorf("function Eval error"))
 	}
 }
 
+// 借りた引数の配列 args で組み込み関数を呼び出す
+// 数の関数は args をそのまま使い、それ以外は複製して渡す (関数が配列を持ち続けることがある)
+func (ip *Interpreter) callBuiltinArgs(fn Func, args []Value) Value {
+	switch fn.(type) {
+	case Func0, Func1, Func2:
+		return ip.callBuiltin(fn, args)
+	}
+	xs := make([]Value, len(args))
+	copy(xs, args)
+	return ip.callBuiltin(fn, xs)
+}
+
 // 組み込み関数表
-var funcTable = make(map[string]Func)
+// 初期化後は読み出し専用で、各インタプリタはこれを複製して使う
+var builtinTable = make(map[string]Func)
 
 // 組み込み関数初期化
 func InitFunc() {
-	funcTable["sqrt"] = Func1(math.Sqrt)
-	funcTable["sin"] = Func1(math.Sin)
-	funcTable["cos"] = Func1(math.Cos)
-	funcTable["tan"] = Func1(math.Tan)
-	funcTable["sinh"] = Func1(math.Sinh)
-	funcTable["cosh"] = Func1(math.Cosh)
-	funcTable["tanh"] = Func1(math.Tanh)
-	funcTable["asin"] = Func1(math.Asin)
-	funcTable["acos"] = Func1(math.Acos)
-	funcTable["atan"] = Func1(math.Atan)
-	funcTable["atan2"] = Func2(math.Atan2)
-	funcTable["exp"] = Func1(math.Exp)
-	funcTable["pow"] = Func2(math.Pow)
-	funcTable["log"] = Func1(math.Log)
-	funcTable["log10"] = Func1(math.Log10)
-	funcTable["log2"] = Func1(math.Log2)
-	funcTable["abs"] = Func1(math.Abs)
+	builtinTable["sqrt"] = Func1(math.Sqrt)
+	builtinTable["sin"] = Func1(math.Sin)
+	builtinTable["cos"] = Func1(math.Cos)
+	builtinTable["tan"] = Func1(math.Tan)
+	builtinTable["sinh"] = Func1(math.Sinh)
+	builtinTable["cosh"] = Func1(math.Cosh)
+	builtinTable["tanh"] = Func1(math.Tanh)
+	builtinTable["asin"] = Func1(math.Asin)
+	builtinTable["acos"] = Func1(math.Acos)
+	builtinTable["atan"] = Func1(math.Atan)
+	builtinTable["atan2"] = Func2(math.Atan2)
+	builtinTable["exp"] = Func1(math.Exp)
+	builtinTable["pow"] = Func2(math.Pow)
+	builtinTable["log"] = Func1(math.Log)
+	builtinTable["log10"] = Func1(math.Log10)
+	builtinTable["log2"] = Func1(math.Log2)
+	builtinTable["abs"] = Func1(math.Abs)
+	initMathFunc()
+	initStrFunc()
+	initListFunc()
+	initMapFunc()
+	initHigherOrderFunc()
+	initMemoFunc()
+	initPureFuncs()
 }
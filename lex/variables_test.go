@@ -21,17 +21,17 @@ func TestAgn_Eval(t *testing.T) {
 			name: "case1",
 			fields: fields{
 				name: Variable("a"),
-				expr: newOp1('+', Value(1)),
+				expr: newOp1('+', Num(1)),
 			},
-			want: Value(1),
+			want: Num(1),
 		},
 		{
 			name: "case2",
 			fields: fields{
 				name: Variable("b"),
-				expr: newOp1('-', Value(1)),
+				expr: newOp1('-', Num(1)),
 			},
-			want: Value(-1),
+			want: Num(-1),
 		},
 		{
 			name: "case3",
@@ -39,7 +39,7 @@ func TestAgn_Eval(t *testing.T) {
 				name: Variable("c"),
 				expr: newOp1('+', Variable("a")),
 			},
-			want: Value(1),
+			want: Num(1),
 		},
 		{
 			name: "case4",
@@ -47,16 +47,17 @@ func TestAgn_Eval(t *testing.T) {
 				name: Variable("d"),
 				expr: newOp2('*', Variable("a"), Variable("b")),
 			},
-			want: Value(-1),
+			want: Num(-1),
 		},
 	}
+	ip := NewInterpreter()
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			a := &Agn{
 				name: tt.fields.name,
 				expr: tt.fields.expr,
 			}
-			if got := a.Eval(nil); got != tt.want {
+			if got := evalNode(ip, a, nil); got != tt.want {
 				t.Errorf("Eval() = %v, want %v", got, tt.want)
 			}
 		})
@@ -78,25 +79,25 @@ func TestApp_Eval(t *testing.T) {
 			name: "case1",
 			fields: fields{
 				fn: Func1(math.Sqrt),
-				xs: []Expr{Value(4)},
+				xs: []Expr{Num(4)},
 			},
-			want: Value(math.Sqrt(4)),
+			want: Num(math.Sqrt(4)),
 		},
 		{
 			name: "case2",
 			fields: fields{
 				fn: Func1(math.Sin),
-				xs: []Expr{Value(math.Pi / 2)},
+				xs: []Expr{Num(math.Pi / 2)},
 			},
-			want: Value(math.Sin(math.Pi / 2)),
+			want: Num(math.Sin(math.Pi / 2)),
 		},
 		{
 			name: "case3",
 			fields: fields{
 				fn: Func2(math.Pow),
-				xs: []Expr{Value(2), Value(4)},
+				xs: []Expr{Num(2), Num(4)},
 			},
-			want: Value(math.Pow(2, 4)),
+			want: Num(math.Pow(2, 4)),
 		},
 	}
 	for _, tt := range tests {
@@ -105,7 +106,7 @@ func TestApp_Eval(t *testing.T) {
 				fn: tt.fields.fn,
 				xs: tt.fields.xs,
 			}
-			if got := a.Eval(nil); got != tt.want {
+			if got := evalNode(NewInterpreter(), a, nil); got != tt.want {
 				t.Errorf("Eval() = %v, want %v", got, tt.want)
 			}
 		})
@@ -227,7 +228,7 @@ func TestInitFunc(t *testing.T) {
 	InitFunc()
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := runtime.FuncForPC(reflect.ValueOf(funcTable[tt.name]).Pointer()).Name()
+			got := runtime.FuncForPC(reflect.ValueOf(builtinTable[tt.name]).Pointer()).Name()
 			if got != tt.want {
 				t.Errorf("InitFunc() failed, got %v, want %v", got, tt.want)
 			}
@@ -244,35 +245,35 @@ func TestVariable_Eval(t *testing.T) {
 		{
 			name: "case1",
 			v:    Variable("a"),
-			want: 1,
+			want: Num(1),
 		},
 		{
 			name: "case2",
 			v:    Variable("b"),
-			want: 3,
+			want: Num(3),
 		},
 		{
 			name: "case3",
 			v:    Variable("c"),
-			want: 5,
+			want: Num(5),
 		},
 		{
 			name: "case4",
 			v:    Variable("d"),
-			want: 10,
+			want: Num(10),
 		},
 	}
-	resetGlobal()
+	ip := NewInterpreter()
 	// 事前の変数代入
-	newAgn(Variable("a"), Value(1)).Eval(nil)
-	newAgn(Variable("b"), Value(3)).Eval(nil)
-	newAgn(Variable("c"), Value(5)).Eval(nil)
-	newAgn(Variable("d"), Value(10)).Eval(nil)
+	evalNode(ip, newAgn(Variable("a"), Num(1)), nil)
+	evalNode(ip, newAgn(Variable("b"), Num(3)), nil)
+	evalNode(ip, newAgn(Variable("c"), Num(5)), nil)
+	evalNode(ip, newAgn(Variable("d"), Num(10)), nil)
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// 事前に変数を代入していないといけない
 			// やらなくてもいいけど、代入してないならpanicするといいよね
-			if got := tt.v.Eval(nil); got != tt.want {
+			if got := evalNode(ip, tt.v, nil); got != tt.want {
 				t.Errorf("Eval() = %v, want %v", got, tt.want)
 			}
 		})
@@ -293,11 +294,11 @@ func Test_newAgn(t *testing.T) {
 			name: "case",
 			args: args{
 				v: Variable("a"),
-				e: Value(1),
+				e: Num(1),
 			},
 			want: &Agn{
 				name: Variable("a"),
-				expr: Value(1),
+				expr: Num(1),
 			},
 		},
 	}
@@ -341,3 +342,97 @@ func Test_newApp(t *testing.T) {
 		})
 	}
 }
+
+func TestLex_resolve(t *testing.T) {
+	lex := &Lex{}
+	lex.pushLocals("a", "b")
+	scope := lex.pushLocals()
+	lex.addLocal("c")
+	lex.addLocal("a")
+	tests := []struct {
+		name Variable
+		want addr
+	}{
+		{"a", addr{true, 0, 1}},
+		{"c", addr{true, 0, 0}},
+		{"b", addr{true, 1, 1}},
+		{"x", addr{}},
+	}
+	for _, tt := range tests {
+		if got := lex.resolve(tt.name); got != tt.want {
+			t.Errorf("resolve(%v) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	lex.popLocals(scope)
+	if got := lex.resolve("a"); got != (addr{true, 0, 0}) {
+		t.Errorf("after pop: resolve(a) = %v", got)
+	}
+}
+
+func TestLocalScopes(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want Value
+	}{
+		{
+			name: "shadowing",
+			src:  "let a = 1 in let a = a + 10 in a end + a end",
+			want: Num(12),
+		},
+		{
+			name: "same name in one let",
+			src:  "let a = 1, a = a + 1, b = a in [a, b] end",
+			want: nums(2, 2),
+		},
+		{
+			name: "unbound yet is global",
+			src:  "a = 100; let b = a, a = 1 in b + a end",
+			want: Num(101),
+		},
+		{
+			name: "assign outer local from closure",
+			src:  "let n = 0 in let f = fn(k) n = n + k end in f(2), f(3), n end end",
+			want: Num(5),
+		},
+		{
+			name: "deep capture",
+			src:  "f = fn(a) fn(b) fn(c) let d = 4 in a * 1000 + b * 100 + c * 10 + d end end end end; f(1)(2)(3)",
+			want: Num(1234),
+		},
+		{
+			name: "loop variable",
+			src:  "s = 0; for x in [1, 2] do for y in [10, 20] do s = s + x * y end end; s",
+			want: Num(90),
+		},
+		{
+			name: "parameter shadows global",
+			src:  "x = 5; def f(x) x += 1 end f(1) + x",
+			want: Num(7),
+		},
+		{
+			name: "global assignment in function",
+			src:  "def set(v) g = v end set(3); g",
+			want: Num(3),
+		},
+	}
+	for _, b := range []Backend{TreeWalk, Bytecode} {
+		for _, tt := range tests {
+			t.Run(b.String()+"/"+tt.name, func(t *testing.T) {
+				ip := NewInterpreter()
+				ip.Backend = b
+				e, err := ip.Parse(tt.src)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := ip.Eval(e)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("Eval() = %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
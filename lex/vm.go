@@ -0,0 +1,279 @@
+package lex
+
+// スタックマシン
+// ユーザ定義関数の呼び出しは Go の再帰ではなく frame を積んで実行する。
+// 末尾位置の呼び出しは frame を積まずに実行中の関数を置き換えるので、呼び出しの深さも増えない
+
+// 呼び出した関数から戻る先
+type frame struct {
+	c    *code
+	pc   int
+	env  *Env
+	sp   int  // 引数を取り除いたあとのスタックの高さ
+	at   *Pos // 呼び出し元の at
+	memo int  // 呼び出し元の memo
+}
+
+// 覚えておいた結果を返すだけの本体 (スタックに積んだ結果で戻る)
+var memoHit = &code{ins: []uint32{uint32(opReturn)}}
+
+// 関数値を呼び出した位置 (なければ nil)
+func (e *Call) pos() *Pos {
+	if e.start.IsValid() {
+		return &e.start
+	}
+	return nil
+}
+
+// for の繰り返しの状態
+type iter struct {
+	elems []Value
+	i     int
+}
+
+// バイトコードを env の環境で実行する
+func (ip *Interpreter) run(c *code, env *Env) Value {
+	stack := make([]Value, 0, 16)
+	var frames []frame
+	var iters []iter
+	// 実行中の関数を関数値として呼び出した位置 (呼び出した先のエラーの位置にする)
+	var at *Pos
+	// 戻ったら結果を覚える呼び出し (frame に積んだ関数の分も続けて持つ)
+	var pending memoPending
+	// pending のうち実行中の関数の分の始まり
+	var memo int
+	defer func() {
+		if r := recover(); r != nil {
+			// 構文木の Call.Eval の locate と同じく、内側の呼び出しから位置を埋める
+			if at != nil {
+				setPos(r, *at)
+			}
+			for i := len(frames) - 1; i >= 0; i-- {
+				if frames[i].at != nil {
+					setPos(r, *frames[i].at)
+				}
+			}
+			panic(r)
+		}
+	}()
+	pc := 0
+	for {
+		ins := c.ins[pc]
+		pc++
+		a := int(ins >> 8)
+		switch opcode(ins & 0xff) {
+		case opConst:
+			stack = append(stack, c.consts[a])
+		case opLoad:
+			e := c.refs[a]
+			ip.tick(e.start)
+			if e.local {
+				stack = append(stack, e.frame(env).vals[e.slot])
+				break
+			}
+			stack = append(stack, e.name.lookUp(ip, e.start))
+		case opLoadName:
+			stack = append(stack, c.names[a].lookUp(ip, Pos{}))
+		case opLookUp:
+			e := c.nodes[a].(*OpAgn)
+			stack = append(stack, ip.load(e.start, e.name, e.addr, env))
+		case opStore:
+			e := c.nodes[a].(*Agn)
+			ip.assign(e.start, e.name, e.addr, stack[len(stack)-1], env)
+		case opOpAgn:
+			n := len(stack)
+			stack[n-2] = c.nodes[a].(*OpAgn).apply(ip, stack[n-2], stack[n-1], env)
+			stack = stack[:n-1]
+		case opConstCheck:
+			c.nodes[a].(*Const).check(ip)
+		case opConstDef:
+			n := len(stack)
+			stack[n-1] = c.nodes[a].(*Const).define(ip, stack[n-1])
+		case opPop:
+			stack = stack[:len(stack)-1]
+		case opTick:
+			ip.tick(c.poss[a])
+		case opLoop:
+			ip.checkInterrupt(c.poss[a])
+			ip.tick(c.poss[a])
+		case opOp1:
+			n := len(stack)
+			stack[n-1] = c.op1s[a].apply(stack[n-1])
+		case opOp2:
+			n := len(stack)
+			stack[n-2] = c.op2s[a].apply(stack[n-2], stack[n-1])
+			stack = stack[:n-1]
+		case opCompare:
+			i, end := int(c.ins[pc]), int(c.ins[pc+1])
+			pc += 2
+			n := len(stack)
+			v := c.chains[a].compare(i, stack[n-2], stack[n-1])
+			switch {
+			case end == 0:
+				stack[n-2] = v
+			case isTrue(v):
+				// 右辺が次の比較の左辺になる
+				stack[n-2] = stack[n-1]
+			default:
+				stack[n-2] = v
+				pc = end
+			}
+			stack = stack[:n-1]
+		case opJump:
+			pc = a
+		case opJumpIfFalse:
+			n := len(stack)
+			v := stack[n-1]
+			stack = stack[:n-1]
+			if !isTrue(v) {
+				pc = a
+			}
+		case opAnd:
+			if !isTrue(stack[len(stack)-1]) {
+				pc = a
+			} else {
+				stack = stack[:len(stack)-1]
+			}
+		case opOr:
+			if isTrue(stack[len(stack)-1]) {
+				pc = a
+			} else {
+				stack = stack[:len(stack)-1]
+			}
+		case opIter:
+			e := c.nodes[a].(*For)
+			n := len(stack)
+			iters = append(iters, iter{elems: e.elems(stack[n-1])})
+			stack = stack[:n-1]
+			env = makeEnv(1, env)
+			env.vals[0] = Nil{}
+		case opNext:
+			it := &iters[len(iters)-1]
+			if it.i == len(it.elems) {
+				iters = iters[:len(iters)-1]
+				env = env.next
+				pc = a
+				break
+			}
+			env.vals[0] = it.elems[it.i]
+			it.i++
+		case opFrame:
+			env = makeEnv(a, env)
+		case opBind:
+			n := len(stack)
+			env.vals[a] = stack[n-1]
+			stack = stack[:n-1]
+		case opUnbind:
+			env = env.next
+		case opClosure:
+			e := c.nodes[a].(*Lambda)
+			ip.tick(e.start)
+			stack = append(stack, &FuncVal{fn: e.fn, env: env})
+		case opCall:
+			e := c.calls[a]
+			base := len(stack) - len(e.xs) - 1
+			f, fenv, v := e.enter(ip, stack[base], stack[base+1:])
+			stack = stack[:base]
+			if f == nil {
+				stack = append(stack, v)
+				break
+			}
+			frames = append(frames, frame{c, pc, env, base, at, memo})
+			c, pc, env, at, memo = f.code, 0, fenv, e.pos(), len(pending)
+			if v, ok := pending.enter(f, fenv); ok {
+				c, pc, stack = memoHit, 0, append(stack, v)
+			}
+		case opCallUser:
+			e := c.apps[a]
+			base := len(stack) - len(e.xs)
+			f := ip.enterCall(e.start, e.fn.(*FuncU))
+			fenv := makeEnv(len(e.xs), nil)
+			copy(fenv.vals, stack[base:])
+			stack = stack[:base]
+			frames = append(frames, frame{c, pc, env, base, at, memo})
+			c, pc, env, at, memo = f.code, 0, fenv, nil, len(pending)
+			if v, ok := pending.enter(f, fenv); ok {
+				c, pc, stack = memoHit, 0, append(stack, v)
+			}
+		case opTailCall:
+			e := c.calls[a]
+			base := len(stack) - len(e.xs) - 1
+			f, fenv, v := e.prepare(ip, stack[base], stack[base+1:])
+			stack = stack[:base]
+			if f == nil {
+				stack = append(stack, v)
+				break
+			}
+			if p := e.pos(); p != nil {
+				at = p
+			}
+			f = ip.replaceCall(Pos{}, f)
+			c, pc, env = f.code, 0, fenv
+			if v, ok := pending.enter(f, fenv); ok {
+				c, pc, stack = memoHit, 0, append(stack, v)
+			}
+		case opTailCallUser:
+			e := c.apps[a]
+			base := len(stack) - len(e.xs)
+			fenv := makeEnv(len(e.xs), nil)
+			copy(fenv.vals, stack[base:])
+			stack = stack[:base]
+			f := ip.replaceCall(e.start, e.fn.(*FuncU))
+			c, pc, env = f.code, 0, fenv
+			if v, ok := pending.enter(f, fenv); ok {
+				c, pc, stack = memoHit, 0, append(stack, v)
+			}
+		case opCallBuiltin:
+			e := c.apps[a]
+			base := len(stack) - len(e.xs)
+			v := e.callBuiltinArgs(ip, stack[base:])
+			stack = append(stack[:base], v)
+		case opList:
+			base := len(stack) - a
+			elems := make([]Value, a)
+			copy(elems, stack[base:])
+			stack = append(stack[:base], newList(elems))
+		case opMap:
+			stack = append(stack, newMap())
+		case opMapSet:
+			n := len(stack)
+			c.nodes[a].(*MapExpr).set(stack[n-3].(*Map), stack[n-2], stack[n-1])
+			stack = stack[:n-2]
+		case opIndex:
+			n := len(stack)
+			stack[n-2] = c.nodes[a].(*Index).get(stack[n-2], stack[n-1])
+			stack = stack[:n-1]
+		case opSlice:
+			e := c.nodes[a].(*Slice)
+			var lo, hi Value
+			if e.hi != nil {
+				hi = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+			if e.lo != nil {
+				lo = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+			n := len(stack)
+			stack[n-1] = e.get(stack[n-1], lo, hi)
+		case opIndexAgn:
+			n := len(stack)
+			stack[n-3] = c.nodes[a].(*IndexAgn).set(stack[n-3], stack[n-2], stack[n-1])
+			stack = stack[:n-2]
+		case opReturn:
+			v := stack[len(stack)-1]
+			pending[memo:].store(v)
+			pending = pending[:memo]
+			if len(frames) == 0 {
+				return v
+			}
+			ip.leaveCall()
+			f := frames[len(frames)-1]
+			frames = frames[:len(frames)-1]
+			c, pc, env, at, memo = f.c, f.pc, f.env, f.at, f.memo
+			stack = append(stack[:f.sp], v)
+		default:
+			panic(runtimeError(Pos{}, "invalid instruction %d", ins&0xff))
+		}
+	}
+}
@@ -1,16 +1,123 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	lg "github.com/sayuen0/calculator-go/lex"
 	"os"
+	"os/signal"
+	"strings"
 )
 
+// 終了コード
+const (
+	exitOK    = 0
+	exitError = 1 // 構文エラー・実行時エラー
+	exitUsage = 2 // 引数の誤り・ファイルが開けない
+	exitInt   = 130
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage:
+  calc                      対話モード (標準入力が端末でなければスクリプトとして実行)
+  calc run file [args...]   ファイルを実行
+  calc -e 'expr;' [args...] 式を実行`)
+	flag.PrintDefaults()
+}
+
 func main() {
-	var lex lg.Lex
-	lex.Init(os.Stdin)
+	os.Exit(run())
+}
+
+func run() int {
+	expr := flag.String("e", "", "evaluate `expr` and exit")
+	quiet := flag.Bool("q", false, "do not print the prompt")
+	depth := flag.Int("depth", lg.DefaultMaxDepth, "maximum depth of user function calls")
+	vm := flag.Bool("vm", false, "evaluate with the bytecode VM")
+	noopt := flag.Bool("noopt", false, "do not optimize the syntax tree")
+	bools := flag.Bool("bool", false, "print booleans as true and false instead of 1 and 0")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+
+	ip := lg.NewInterpreter()
+	// 対話モード以外ではプロンプトと関数名を表示しない
+	ip.Quiet = true
+	ip.MaxDepth = *depth
+	if *vm {
+		ip.Backend = lg.Bytecode
+	}
+	ip.NoOptimize = *noopt
+	ip.BoolNames = *bools
+	handleInterrupt(ip)
+	switch {
+	case *expr != "":
+		ip.SetArgs(args)
+		return exitCode(ip.Run(strings.NewReader(*expr), "-e"))
+	case len(args) > 0 && args[0] == "run":
+		if len(args) < 2 {
+			usage()
+			return exitUsage
+		}
+		f, err := os.Open(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+		defer f.Close()
+		ip.SetArgs(args[2:])
+		return exitCode(ip.Run(f, args[1]))
+	case len(args) > 0:
+		usage()
+		return exitUsage
+	case !isTerminal(os.Stdin):
+		// パイプやリダイレクトからの入力はスクリプトとして扱う
+		return exitCode(ip.Run(os.Stdin, "<stdin>"))
+	}
+	ip.Quiet = *quiet
+	ip.Init(os.Stdin)
 	for {
-		if lg.TopLevel(&lex) {
+		if ip.TopLevel() {
 			break
 		}
 	}
+	return exitOK
+}
+
+// Ctrl-C で評価中の式だけを中断する
+// 評価中でなければ (入力待ちなど) 終了する
+func handleInterrupt(ip *lg.Interpreter) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		for range c {
+			if !ip.Interrupt() {
+				fmt.Fprintln(os.Stderr)
+				os.Exit(exitInt)
+			}
+		}
+	}()
+}
+
+func exitCode(err error) int {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, lg.FormatError(err))
+		// Ctrl-C で中断したスクリプトは対話モードと同じ終了コードにする
+		var ie *lg.InterruptError
+		if errors.As(err, &ie) {
+			return exitInt
+		}
+		return exitError
+	}
+	return exitOK
+}
+
+// 端末からの入力かどうか
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
 }